@@ -1,10 +1,21 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/1Asi1/gophermart/internal/server"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	s := server.New()
 	s.Run()
 }
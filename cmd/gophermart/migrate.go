@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/1Asi1/gophermart/internal/repository"
+	"github.com/golang-migrate/migrate/v4"
+)
+
+const migrateUsage = `usage: gophermart migrate [-d dsn] <command>
+
+commands:
+  up          apply all pending migrations
+  down N      roll back N migrations (default 1)
+  goto V      migrate up or down to version V
+  version     print the current version and dirty flag
+  force V     set version V without running migrations, clears the dirty flag`
+
+// runMigrate manages the schema with the migrations embedded into the binary.
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), migrateUsage)
+	}
+	db := fs.String("d", "", "dsn connecting to postgres")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("fs.Parse: %w", err)
+	}
+
+	dsn := *db
+	if dbDSN, ok := os.LookupEnv("DATABASE_URI"); ok {
+		dsn = dbDSN
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("missing command")
+	}
+
+	m, err := repository.NewMigrate(dsn)
+	if err != nil {
+		return fmt.Errorf("repository.NewMigrate: %w", err)
+	}
+	defer m.Close()
+
+	cmd, arg := fs.Arg(0), fs.Arg(1)
+	switch cmd {
+	case "up":
+		err = m.Up()
+	case "down":
+		n := 1
+		if arg != "" {
+			if n, err = strconv.Atoi(arg); err != nil || n <= 0 {
+				return fmt.Errorf("invalid number of steps: %q", arg)
+			}
+		}
+		err = m.Steps(-n)
+	case "goto":
+		var v uint64
+		if v, err = strconv.ParseUint(arg, 10, 0); err != nil {
+			return fmt.Errorf("invalid version: %q", arg)
+		}
+		err = m.Migrate(uint(v))
+	case "force":
+		var v int
+		if v, err = strconv.Atoi(arg); err != nil {
+			return fmt.Errorf("invalid version: %q", arg)
+		}
+		err = m.Force(v)
+	case "version":
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown command: %q", cmd)
+	}
+
+	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("migrate %s: %w", cmd, err)
+	}
+
+	version, dirty, err := m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		fmt.Println("no migrations applied")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("m.Version: %w", err)
+	}
+
+	fmt.Printf("version: %d, dirty: %t\n", version, dirty)
+
+	return nil
+}
@@ -3,6 +3,8 @@ package config
 import (
 	"flag"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/rs/zerolog"
 )
@@ -11,8 +13,66 @@ type Config struct {
 	ServerAddr  string
 	DBConnDSN   string
 	AccrualAddr string
+	AutoMigrate bool
+	// AdminTokens maps an operator name to the token of the admin API.
+	AdminTokens map[string]string
+	// NotifierFile receives password reset tokens, they are logged when empty.
+	NotifierFile string
+	// TrustedProxies are addresses and CIDR ranges separated by commas whose
+	// X-Forwarded-For header tells the client address. Set by TRUSTED_PROXIES.
+	TrustedProxies string
+
+	// Login and password policy, set by the LOGIN_MIN_LENGTH, LOGIN_MAX_LENGTH,
+	// PASSWORD_MIN_LENGTH and PASSWORD_DENYLIST_FILE environment variables.
+	LoginMinLen          int
+	LoginMaxLen          int
+	PasswordMinLen       int
+	PasswordDenylistFile string
+
+	// PointsExpiryMonths is how long earned points live, zero keeps them forever.
+	// Set by POINTS_EXPIRY_MONTHS, POINTS_EXPIRING_SOON_DAYS sets the window of
+	// points reported as expiring soon in the balance.
+	PointsExpiryMonths     int
+	PointsExpiringSoonDays int
+	// AccrualHoldDays keeps accruals pending before they can be spent, zero
+	// makes them spendable at once and leaves cancellations after processing
+	// to an operator clawback. Set by ACCRUAL_HOLD_DAYS.
+	AccrualHoldDays int
+	// HoldTTLMinutes is how long a checkout hold waits for capture, set by
+	// HOLD_TTL_MINUTES.
+	HoldTTLMinutes int
+	// TransferDailyLimit caps the points a user sends to others per day, zero
+	// means no limit. Set by TRANSFER_DAILY_LIMIT.
+	TransferDailyLimit int
+
+	// Tiers are name:min_accrued:multiplier triples separated by commas, a
+	// tier is reached by the points accrued in the last TierWindowDays.
+	// Set by TIERS and TIER_WINDOW_DAYS.
+	Tiers          string
+	TierWindowDays int
+
+	// ReferralBonus is credited to both users of a referral on the first order
+	// of the referred user, zero turns it off. Set by REFERRAL_BONUS.
+	ReferralBonus int
+	// ReferralMaxRewards caps the referrals rewarded per referrer, zero means
+	// no limit. Set by REFERRAL_MAX_REWARDS.
+	ReferralMaxRewards int
 }
 
+const (
+	defaultLoginMinLen    = 3
+	defaultLoginMaxLen    = 64
+	defaultPasswordMinLen = 8
+
+	defaultPointsExpiringSoonDays = 30
+	defaultAccrualHoldDays        = 0
+	defaultHoldTTLMinutes         = 30
+	defaultTransferDailyLimit     = 1000
+	defaultTierWindowDays         = 365
+	defaultReferralBonus          = 0
+	defaultReferralMaxRewards     = 10
+)
+
 func New(log zerolog.Logger) Config {
 	l := log.With().Str("config", "New").Logger()
 
@@ -20,6 +80,9 @@ func New(log zerolog.Logger) Config {
 	add := flag.String("a", "127.0.0.1:8080", "address and port to run service")
 	accrualAdd := flag.String("r", "127.0.0.1:8081", "address accrual servers")
 	db := flag.String("d", "", "dsn connecting to postgres")
+	autoMigrate := flag.Bool("m", true, "apply database migrations on start")
+	adminTokens := flag.String("t", "", "admin API operators as name:token pairs separated by commas")
+	notifierFile := flag.String("n", "", "file receiving password reset tokens")
 	flag.Parse()
 
 	addrEnv, ok := os.LookupEnv("RUN_ADDRESS")
@@ -47,5 +110,81 @@ func New(log zerolog.Logger) Config {
 		cfg.DBConnDSN = *db
 	}
 
+	cfg.AutoMigrate = *autoMigrate
+	autoMigrateEnv, ok := os.LookupEnv("AUTO_MIGRATE")
+	if ok {
+		v, err := strconv.ParseBool(autoMigrateEnv)
+		if err != nil {
+			l.Error().Err(err).Msg("strconv.ParseBool key: AUTO_MIGRATE")
+		} else {
+			cfg.AutoMigrate = v
+		}
+	}
+	l.Info().Msgf("auto migrate value: %t", cfg.AutoMigrate)
+
+	tokens := *adminTokens
+	adminTokensEnv, ok := os.LookupEnv("ADMIN_TOKENS")
+	if ok {
+		tokens = adminTokensEnv
+	}
+	cfg.AdminTokens = parseAdminTokens(tokens)
+	l.Info().Msgf("admin operators count: %d", len(cfg.AdminTokens))
+
+	notifierFileEnv, ok := os.LookupEnv("NOTIFIER_FILE")
+	if ok {
+		cfg.NotifierFile = notifierFileEnv
+	} else {
+		cfg.NotifierFile = *notifierFile
+	}
+
+	cfg.LoginMinLen = lookupInt(l, "LOGIN_MIN_LENGTH", defaultLoginMinLen)
+	cfg.LoginMaxLen = lookupInt(l, "LOGIN_MAX_LENGTH", defaultLoginMaxLen)
+	cfg.PasswordMinLen = lookupInt(l, "PASSWORD_MIN_LENGTH", defaultPasswordMinLen)
+	cfg.PasswordDenylistFile = os.Getenv("PASSWORD_DENYLIST_FILE")
+
+	cfg.PointsExpiryMonths = lookupInt(l, "POINTS_EXPIRY_MONTHS", 0)
+	cfg.PointsExpiringSoonDays = lookupInt(l, "POINTS_EXPIRING_SOON_DAYS", defaultPointsExpiringSoonDays)
+	l.Info().Msgf("points expiry months value: %d", cfg.PointsExpiryMonths)
+
+	cfg.AccrualHoldDays = lookupInt(l, "ACCRUAL_HOLD_DAYS", defaultAccrualHoldDays)
+	l.Info().Msgf("accrual hold days value: %d", cfg.AccrualHoldDays)
+
+	cfg.HoldTTLMinutes = lookupInt(l, "HOLD_TTL_MINUTES", defaultHoldTTLMinutes)
+	cfg.TransferDailyLimit = lookupInt(l, "TRANSFER_DAILY_LIMIT", defaultTransferDailyLimit)
+
+	cfg.Tiers = os.Getenv("TIERS")
+	cfg.TierWindowDays = lookupInt(l, "TIER_WINDOW_DAYS", defaultTierWindowDays)
+	cfg.ReferralBonus = lookupInt(l, "REFERRAL_BONUS", defaultReferralBonus)
+	cfg.ReferralMaxRewards = lookupInt(l, "REFERRAL_MAX_REWARDS", defaultReferralMaxRewards)
+	cfg.TrustedProxies = os.Getenv("TRUSTED_PROXIES")
+
 	return cfg
 }
+
+func lookupInt(l zerolog.Logger, key string, def int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		l.Error().Err(err).Msgf("strconv.Atoi key: %s", key)
+		return def
+	}
+
+	return v
+}
+
+func parseAdminTokens(value string) map[string]string {
+	tokens := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		name, token, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || name == "" || token == "" {
+			continue
+		}
+		tokens[name] = token
+	}
+
+	return tokens
+}
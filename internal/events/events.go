@@ -0,0 +1,151 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	TypeOrder   = "order"
+	TypeBalance = "balance"
+)
+
+const (
+	historySize = 100
+	bufferSize  = 16
+	// historyTTL is how long the history of a user without subscribers is
+	// kept after the last event, long enough for a client to reconnect.
+	historyTTL = 10 * time.Minute
+)
+
+type Event struct {
+	ID     int64
+	UserID uuid.UUID
+	Type   string
+	Data   any
+}
+
+// Hub fans out events to the subscribers of a user and keeps the last
+// historySize events of every user so a reconnecting client can resume
+// from Last-Event-ID. History lives in memory and is lost on restart, the
+// history of a user without subscribers is dropped after historyTTL.
+//
+// Event IDs are the microseconds of the publish time, kept increasing, so the
+// IDs of a restarted process follow the ones clients saw before the restart
+// and a stale Last-Event-ID replays nothing instead of the wrong events.
+//
+// A hub only reaches the clients connected to its own process: the stream
+// works with a single instance of the server, behind a load balancer the
+// events published by one instance never reach the clients of another.
+type Hub struct {
+	mu      sync.Mutex
+	seq     int64
+	subs    map[uuid.UUID]map[chan Event]struct{}
+	history map[uuid.UUID]history
+	sweptAt time.Time
+}
+
+type history struct {
+	events    []Event
+	updatedAt time.Time
+}
+
+func New() *Hub {
+	return &Hub{
+		subs:    make(map[uuid.UUID]map[chan Event]struct{}),
+		history: make(map[uuid.UUID]history),
+		sweptAt: time.Now(),
+	}
+}
+
+func (h *Hub) Publish(userID uuid.UUID, typ string, data any) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	h.sweep(now)
+
+	h.seq++
+	if v := now.UnixMicro(); v > h.seq {
+		h.seq = v
+	}
+	event := Event{ID: h.seq, UserID: userID, Type: typ, Data: data}
+
+	events := append(h.history[userID].events, event)
+	if len(events) > historySize {
+		events = events[len(events)-historySize:]
+	}
+	h.history[userID] = history{events: events, updatedAt: now}
+
+	for ch := range h.subs[userID] {
+		select {
+		case ch <- event:
+		default:
+			// Slow subscriber: drop it, the client reconnects with Last-Event-ID.
+			delete(h.subs[userID], ch)
+			close(ch)
+		}
+	}
+	if len(h.subs[userID]) == 0 {
+		delete(h.subs, userID)
+	}
+}
+
+// sweep drops the idle history of users without subscribers, at most once
+// per historyTTL. It must run with the lock held.
+func (h *Hub) sweep(now time.Time) {
+	if now.Sub(h.sweptAt) < historyTTL {
+		return
+	}
+	h.sweptAt = now
+
+	for id, v := range h.history {
+		if _, ok := h.subs[id]; !ok && now.Sub(v.updatedAt) >= historyTTL {
+			delete(h.history, id)
+		}
+	}
+}
+
+// Subscribe registers a subscriber and returns the stored events newer than lastID.
+// The returned func must be called to unsubscribe.
+func (h *Hub) Subscribe(userID uuid.UUID, lastID int64) (<-chan Event, []Event, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var replay []Event
+	if lastID > 0 {
+		for _, v := range h.history[userID].events {
+			if v.ID > lastID {
+				replay = append(replay, v)
+			}
+		}
+	}
+
+	ch := make(chan Event, bufferSize)
+	if h.subs[userID] == nil {
+		h.subs[userID] = make(map[chan Event]struct{})
+	}
+	h.subs[userID][ch] = struct{}{}
+
+	cancel := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		if _, ok := h.subs[userID][ch]; ok {
+			delete(h.subs[userID], ch)
+			close(ch)
+		}
+		if len(h.subs[userID]) == 0 {
+			delete(h.subs, userID)
+			// The client may reconnect, its history is kept from now.
+			if v, ok := h.history[userID]; ok {
+				v.updatedAt = time.Now()
+				h.history[userID] = v
+			}
+		}
+	}
+
+	return ch, replay, cancel
+}
@@ -1,6 +1,7 @@
 package accrual
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 
@@ -21,9 +22,10 @@ type Goods struct {
 }
 
 type Response struct {
-	Order   string   `json:"order"`
-	Status  string   `json:"status"`
-	Accrual *float32 `json:"accrual,omitempty"`
+	Order   string          `json:"order"`
+	Status  string          `json:"status"`
+	Accrual *float32        `json:"accrual,omitempty"`
+	Payload json.RawMessage `json:"-"`
 }
 
 type Client struct {
@@ -56,6 +58,7 @@ func (c Client) GetOrder(num string) (Response, error) {
 		}
 		return Response{}, fmt.Errorf(":%w", oops.ErrStatusNotOK)
 	}
+	result.Payload = resp.Body()
 
 	return result, nil
 }
@@ -3,29 +3,61 @@ package integration
 import (
 	"context"
 	"errors"
+	"fmt"
+	"math"
 	"sync/atomic"
 	"time"
 
+	"github.com/1Asi1/gophermart/internal/events"
 	"github.com/1Asi1/gophermart/internal/integration/accrual"
+	"github.com/1Asi1/gophermart/internal/integration/webhook"
+	"github.com/1Asi1/gophermart/internal/models"
 	"github.com/1Asi1/gophermart/internal/oops"
 	"github.com/1Asi1/gophermart/internal/repository"
+	"github.com/google/uuid"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
 const (
 	accrualStatusProcessed = "PROCESSED"
+	// accrualStatusCancelled is reported for an order returned after it was processed.
+	accrualStatusCancelled = "CANCELLED"
 )
 const (
 	workCounter = 10
 	jobCounter  = 100
 	timeSleep   = 60
+
+	recheckInterval = 10 * time.Minute
 )
 
 type Store interface {
-	Update(context.Context, repository.Order) error
-	UpdateBalance(ctx context.Context, order repository.Order) error
+	Update(context.Context, repository.Order, *repository.OrderEvent, repository.Notify[repository.Order]) error
+	UpdateBalance(
+		ctx context.Context,
+		order repository.Order,
+		terms repository.CreditTerms,
+		bonuses repository.Bonuses,
+		event *repository.OrderEvent,
+		notify repository.Notify[repository.Order],
+	) error
 	GetOrdersNumbers(context.Context, int) ([]repository.Order, error)
+	HeldOrders(context.Context) ([]repository.Order, error)
+	ClawbackOrder(
+		context.Context,
+		repository.Clawback,
+		repository.Notify[repository.Clawed],
+		repository.Audit[repository.Clawed],
+	) (repository.Order, repository.Balance, float32, error)
+	Balance(context.Context, uuid.UUID) (repository.Balance, error)
+	UserTier(context.Context, uuid.UUID) (string, error)
+	ActiveCampaigns(context.Context, time.Time) ([]repository.Campaign, error)
+	RewardReferral(
+		context.Context,
+		repository.ReferralReward,
+		repository.Notify[uuid.UUID],
+	) (uuid.UUID, repository.Balance, repository.Balance, error)
 }
 
 type worker struct {
@@ -33,16 +65,42 @@ type worker struct {
 	err chan error
 }
 
+type Config struct {
+	// PointsExpiryMonths is how long credited accruals live, zero keeps them forever.
+	PointsExpiryMonths int
+	// HoldPeriod keeps credited accruals pending before they can be spent.
+	// Processed orders are polled for a cancellation only during the hold,
+	// with no hold a cancelled order is taken back by an operator clawback.
+	HoldPeriod time.Duration
+	// Tiers multiply the accrual credited to a user by the user's tier.
+	Tiers models.Tiers
+	// ReferralBonus is credited to a referred user and to the referrer for the
+	// first order of the referred user, zero turns referral rewards off.
+	// ReferralMaxRewards caps the rewards of a referrer, zero means no limit.
+	ReferralBonus      float32
+	ReferralMaxRewards int
+}
+
 type OrdersManager struct {
 	client *accrual.Client
 	store  Store
+	hub    *events.Hub
+	cfg    Config
 	log    zerolog.Logger
 }
 
-func New(client *accrual.Client, store Store, log zerolog.Logger) OrdersManager {
+func New(
+	client *accrual.Client,
+	store Store,
+	hub *events.Hub,
+	cfg Config,
+	log zerolog.Logger,
+) OrdersManager {
 	return OrdersManager{
 		client: client,
 		store:  store,
+		hub:    hub,
+		cfg:    cfg,
 		log:    log,
 	}
 }
@@ -73,6 +131,13 @@ func (o OrdersManager) Sync(ctx context.Context) {
 			stop.Store(false)
 		}
 	}()
+
+	// Processed orders are checked again while their accrual is on hold,
+	// a cancellation takes the accrual back. Without a hold nothing is
+	// rechecked, see Config.HoldPeriod.
+	if o.cfg.HoldPeriod > 0 {
+		go o.recheck(ctx, workers.job, stop)
+	}
 	for range ticker.C {
 		if !stop.Load() {
 			orders, err := o.store.GetOrdersNumbers(ctx, offset)
@@ -88,6 +153,37 @@ func (o OrdersManager) Sync(ctx context.Context) {
 	}
 }
 
+func (o OrdersManager) recheck(ctx context.Context, job chan<- repository.Order, stop *atomic.Bool) {
+	l := log.With().Str("integration", "recheck").Logger()
+	ticker := time.NewTicker(recheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if stop.Load() {
+				continue
+			}
+
+			orders, err := o.store.HeldOrders(ctx)
+			if err != nil {
+				l.Error().Err(err).Msg("o.store.HeldOrders")
+				continue
+			}
+
+			for _, j := range orders {
+				select {
+				case <-ctx.Done():
+					return
+				case job <- j:
+				}
+			}
+		}
+	}
+}
+
 func (o OrdersManager) orderWork(order repository.Order, errCh chan error) {
 	l := log.With().Str("integration", "orderWork").Logger()
 
@@ -100,6 +196,11 @@ func (o OrdersManager) orderWork(order repository.Order, errCh chan error) {
 		return
 	}
 
+	if resp.Status == accrualStatusCancelled {
+		o.clawback(order, resp)
+		return
+	}
+
 	data := repository.Order{
 		UserID:  order.UserID,
 		Number:  order.Number,
@@ -108,18 +209,256 @@ func (o OrdersManager) orderWork(order repository.Order, errCh chan error) {
 		Checked: order.Checked,
 	}
 
-	if data.Status == accrualStatusProcessed && data.Accrual != nil && !data.Checked {
+	// A credited order is only checked again for a cancellation, its accrual
+	// stays as credited.
+	if order.Checked {
+		data.Accrual = order.Accrual
+	}
+
+	credit := data.Status == accrualStatusProcessed && data.Accrual != nil && !data.Checked
+	var terms repository.CreditTerms
+	var bonuses repository.Bonuses
+	if credit {
+		tier, err := o.store.UserTier(context.Background(), order.UserID)
+		if err != nil {
+			l.Error().Err(err).Msg("o.store.UserTier")
+			return
+		}
+
+		// The order keeps the credited amount, a clawback takes back exactly that
+		// with the bonuses recorded for the order.
+		credited := multiply(*data.Accrual, o.cfg.Tiers.Get(tier).Multiplier)
+		now := time.Now()
+		bonuses, err = o.bonuses(models.OrderFacts{
+			CreditedAt: now,
+			Accrual:    *data.Accrual,
+			Tier:       tier,
+		}, credited)
+		if err != nil {
+			l.Error().Err(err).Msg("o.bonuses")
+			return
+		}
+
+		data.ReportedAccrual = data.Accrual
+		data.Accrual = &credited
 		data.Checked = true
-		err := o.store.UpdateBalance(context.Background(), data)
+		availableAt := now.Add(o.cfg.HoldPeriod)
+		terms = repository.CreditTerms{
+			AvailableAt: &availableAt,
+			ExpiresAt:   models.PointsExpiry(now, o.cfg.PointsExpiryMonths),
+		}
+	}
+
+	// A status change goes to the order history and to the webhooks in the
+	// transaction that stores it.
+	var event *repository.OrderEvent
+	var notify repository.Notify[repository.Order]
+	if data.Status != order.Status {
+		event = &repository.OrderEvent{
+			UserID:         order.UserID,
+			Number:         order.Number,
+			PreviousStatus: order.Status,
+			Status:         data.Status,
+			Accrual:        data.Accrual,
+			Payload:        resp.Payload,
+		}
+		notify = func(v repository.Order) ([]repository.WebhookEvent, error) {
+			return webhook.NewEvents(webhook.EventOrderStatusChanged, v.UserID, orderStatus(v, order.UploadedAt))
+		}
+	}
+
+	if credit {
+		err = o.store.UpdateBalance(context.Background(), data, terms, bonuses, event,
+			func(v repository.Order) ([]repository.WebhookEvent, error) {
+				result, err := webhook.NewEvents(webhook.EventAccrualCredited, v.UserID, orderStatus(v, order.UploadedAt))
+				if err != nil || notify == nil {
+					return result, err
+				}
+
+				changed, err := notify(v)
+				if err != nil {
+					return nil, err
+				}
+
+				return append(result, changed...), nil
+			})
 		if err != nil {
+			// Another worker credited the order first, it published the change.
+			if errors.Is(err, oops.ErrOrderCredited) {
+				l.Warn().Msg("order already credited")
+				return
+			}
+
 			l.Error().Err(err).Msg("o.store.UpdateBalance")
 			return
 		}
+
+		if o.cfg.ReferralBonus > 0 {
+			o.referral(data, terms)
+		}
+		o.publishBalance(order.UserID)
+	} else {
+		err = o.store.Update(context.Background(), data, event, notify)
+		if err != nil {
+			l.Error().Err(err).Msg("o.store.Update")
+			return
+		}
+	}
+
+	if data.Status != order.Status {
+		o.hub.Publish(order.UserID, events.TypeOrder, orderStatus(data, order.UploadedAt))
+	}
+}
+
+// bonuses evaluates the running campaigns against the order once the store
+// counts the credited orders of the user, the facts are what the accrual system
+// reported and credited is the accrual after the tier multiplier. No running
+// campaigns give no bonuses.
+func (o OrdersManager) bonuses(facts models.OrderFacts, credited float32) (repository.Bonuses, error) {
+	campaigns, err := o.store.ActiveCampaigns(context.Background(), facts.CreditedAt)
+	if err != nil {
+		return nil, fmt.Errorf("o.store.ActiveCampaigns: %w", err)
 	}
 
-	err = o.store.Update(context.Background(), data)
+	if len(campaigns) == 0 {
+		return nil, nil
+	}
+
+	return func(orders int) ([]repository.Bonus, error) {
+		facts.Orders = orders
+
+		var bonuses []repository.Bonus
+		for _, v := range campaigns {
+			campaign := models.Campaign{
+				ID:         v.ID,
+				StartsAt:   v.StartsAt,
+				EndsAt:     v.EndsAt,
+				MinOrders:  v.MinOrders,
+				MaxOrders:  v.MaxOrders,
+				MinAccrual: v.MinAccrual,
+				Tiers:      v.Tiers,
+				BonusType:  v.BonusType,
+				BonusValue: v.BonusValue,
+				Active:     v.Active,
+			}
+			if !campaign.Applies(facts) {
+				continue
+			}
+
+			if amount := campaign.Bonus(credited); amount > 0 {
+				bonuses = append(bonuses, repository.Bonus{CampaignID: v.ID, Amount: amount})
+			}
+		}
+
+		return bonuses, nil
+	}, nil
+}
+
+func orderStatus(order repository.Order, uploadedAt time.Time) models.Order {
+	return models.Order{
+		Number:     order.Number,
+		Status:     order.Status,
+		Accrual:    order.Accrual,
+		UploadedAt: uploadedAt,
+	}
+}
+
+func multiply(accrual, multiplier float32) float32 {
+	return float32(math.Round(float64(accrual)*float64(multiplier)*100) / 100)
+}
+
+func (o OrdersManager) clawback(order repository.Order, resp accrual.Response) {
+	l := log.With().Str("integration", "clawback").Logger()
+
+	_, balance, amount, err := o.store.ClawbackOrder(context.Background(), repository.Clawback{
+		Number:  order.Number,
+		Payload: resp.Payload,
+	}, webhook.ClawbackEvents, nil)
 	if err != nil {
-		l.Error().Err(err).Msg("o.store.Update")
+		l.Error().Err(err).Msg("o.store.ClawbackOrder")
 		return
 	}
+
+	status := models.Order{
+		Number:     order.Number,
+		Status:     repository.OrderStatusCancelled,
+		Accrual:    order.Accrual,
+		UploadedAt: order.UploadedAt,
+	}
+	o.hub.Publish(order.UserID, events.TypeOrder, status)
+
+	if amount > 0 {
+		o.hub.Publish(order.UserID, events.TypeBalance, models.Balance{
+			Current:   balance.Current,
+			Pending:   balance.Pending,
+			Held:      balance.Held,
+			Withdrawn: balance.Withdrawn,
+			Debt:      balance.Debt,
+		})
+	}
+}
+
+// referral rewards the referral of the user on the first order credited, an
+// order credited later finds the referral rewarded already. The referee
+// balance is published with the order.
+func (o OrdersManager) referral(order repository.Order, terms repository.CreditTerms) {
+	l := log.With().Str("integration", "referral").Logger()
+
+	referrerID, referrer, _, err := o.store.RewardReferral(context.Background(), repository.ReferralReward{
+		RefereeID:  order.UserID,
+		Number:     order.Number,
+		Amount:     o.cfg.ReferralBonus,
+		MaxRewards: o.cfg.ReferralMaxRewards,
+		Terms:      terms,
+	}, func(referrerID uuid.UUID) ([]repository.WebhookEvent, error) {
+		rewards := map[uuid.UUID]string{
+			referrerID:   models.ReferralRoleReferrer,
+			order.UserID: models.ReferralRoleReferee,
+		}
+
+		var result []repository.WebhookEvent
+		for id, role := range rewards {
+			event, err := webhook.NewEvent(webhook.EventReferralRewarded, id, models.ReferralBonus{
+				Role:  role,
+				Order: order.Number,
+				Sum:   o.cfg.ReferralBonus,
+			})
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, event)
+		}
+
+		return result, nil
+	})
+	if err != nil {
+		if !errors.Is(err, oops.ErrEmptyData) {
+			l.Error().Err(err).Msg("o.store.RewardReferral")
+		}
+		return
+	}
+
+	o.hub.Publish(referrerID, events.TypeBalance, models.Balance{
+		Current:   referrer.Current,
+		Pending:   referrer.Pending,
+		Held:      referrer.Held,
+		Withdrawn: referrer.Withdrawn,
+		Debt:      referrer.Debt,
+	})
+}
+
+func (o OrdersManager) publishBalance(id uuid.UUID) {
+	balance, err := o.store.Balance(context.Background(), id)
+	if err != nil {
+		o.log.Error().Err(err).Msg("o.store.Balance")
+		return
+	}
+
+	o.hub.Publish(id, events.TypeBalance, models.Balance{
+		Current:   balance.Current,
+		Pending:   balance.Pending,
+		Held:      balance.Held,
+		Withdrawn: balance.Withdrawn,
+		Debt:      balance.Debt,
+	})
 }
@@ -0,0 +1,282 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/1Asi1/gophermart/internal/models"
+	"github.com/1Asi1/gophermart/internal/repository"
+	"github.com/go-resty/resty/v2"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+)
+
+const (
+	EventOrderStatusChanged = "order.status_changed"
+	EventAccrualCredited    = "accrual.credited"
+	EventWithdrawalMade     = "withdrawal.made"
+	EventWithdrawalReversed = "withdrawal.reversed"
+	EventAccrualClawedBack  = "accrual.clawed_back"
+	EventTransferMade       = "transfer.made"
+	EventReferralRewarded   = "referral.rewarded"
+)
+
+// Events lists every event type a webhook can subscribe to.
+var Events = []string{
+	EventOrderStatusChanged,
+	EventAccrualCredited,
+	EventWithdrawalMade,
+	EventWithdrawalReversed,
+	EventAccrualClawedBack,
+	EventTransferMade,
+	EventReferralRewarded,
+}
+
+const (
+	claimLimit     = 100
+	maxAttempts    = 10
+	requestTimeout = 10 * time.Second
+	// endpointWorkers bounds the endpoints delivered to at once, the
+	// deliveries of one endpoint are sent one by one.
+	endpointWorkers = 8
+	// leaseTimeout outlasts a claimed batch delivered one by one with every
+	// request timing out, so no other instance claims a delivery in flight.
+	leaseTimeout = claimLimit*requestTimeout + time.Minute
+	backoffBase  = 10 * time.Second
+	backoffMax   = time.Hour
+)
+
+type Store interface {
+	ClaimWebhookDeliveries(context.Context, int, time.Duration) ([]repository.WebhookDelivery, error)
+	UpdateWebhookDelivery(context.Context, repository.WebhookDelivery) error
+}
+
+type Event struct {
+	Type       string    `json:"type"`
+	UserID     uuid.UUID `json:"user_id"`
+	OccurredAt time.Time `json:"occurred_at"`
+	Data       any       `json:"data"`
+}
+
+type Dispatcher struct {
+	http  *resty.Client
+	store Store
+	log   zerolog.Logger
+}
+
+func New(store Store, log zerolog.Logger) Dispatcher {
+	client := resty.New().SetTimeout(requestTimeout)
+	return Dispatcher{http: client, store: store, log: log}
+}
+
+// NewEvent builds an event for the store to queue in the transaction of the
+// change it reports, delivery happens in Sync.
+func NewEvent(eventType string, userID uuid.UUID, data any) (repository.WebhookEvent, error) {
+	payload, err := json.Marshal(Event{
+		Type:       eventType,
+		UserID:     userID,
+		OccurredAt: time.Now(),
+		Data:       data,
+	})
+	if err != nil {
+		return repository.WebhookEvent{}, fmt.Errorf("json.Marshal: %w", err)
+	}
+
+	return repository.WebhookEvent{Type: eventType, Payload: payload}, nil
+}
+
+// NewEvents is NewEvent for a change reported by a single event.
+func NewEvents(eventType string, userID uuid.UUID, data any) ([]repository.WebhookEvent, error) {
+	event, err := NewEvent(eventType, userID, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return []repository.WebhookEvent{event}, nil
+}
+
+// ClawbackEvents report the cancellation of an order, and the accrual taken
+// back when there was one.
+func ClawbackEvents(c repository.Clawed) ([]repository.WebhookEvent, error) {
+	status := models.Order{
+		Number:     c.Order.Number,
+		Status:     repository.OrderStatusCancelled,
+		Accrual:    c.Order.Accrual,
+		UploadedAt: c.Order.UploadedAt,
+	}
+
+	events, err := NewEvents(EventOrderStatusChanged, c.Order.UserID, status)
+	if err != nil || c.Amount <= 0 {
+		return events, err
+	}
+
+	event, err := NewEvent(EventAccrualClawedBack, c.Order.UserID, status)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(events, event), nil
+}
+
+// Known reports whether eventType is one of Events.
+func Known(eventType string) bool {
+	for _, v := range Events {
+		if v == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func (d Dispatcher) Sync(ctx context.Context) {
+	l := d.log.With().Str("webhook", "sync").Logger()
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deliveries, err := d.store.ClaimWebhookDeliveries(ctx, claimLimit, leaseTimeout)
+			if err != nil {
+				l.Error().Err(err).Msg("d.store.ClaimWebhookDeliveries")
+				continue
+			}
+
+			d.deliverAll(ctx, deliveries)
+		}
+	}
+}
+
+// deliverAll sends the claimed deliveries to their endpoints concurrently, at
+// most endpointWorkers endpoints at a time, so a slow endpoint only delays its
+// own deliveries.
+func (d Dispatcher) deliverAll(ctx context.Context, deliveries []repository.WebhookDelivery) {
+	// The claim returns deliveries in no particular order, ids follow the
+	// order the events were queued in.
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].ID < deliveries[j].ID
+	})
+
+	var endpoints []uuid.UUID
+	byEndpoint := make(map[uuid.UUID][]repository.WebhookDelivery)
+	for _, v := range deliveries {
+		if _, ok := byEndpoint[v.WebhookID]; !ok {
+			endpoints = append(endpoints, v.WebhookID)
+		}
+		byEndpoint[v.WebhookID] = append(byEndpoint[v.WebhookID], v)
+	}
+
+	sem := make(chan struct{}, endpointWorkers)
+	var wg sync.WaitGroup
+	for _, id := range endpoints {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(deliveries []repository.WebhookDelivery) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			d.deliverEndpoint(ctx, deliveries)
+		}(byEndpoint[id])
+	}
+	wg.Wait()
+}
+
+// deliverEndpoint sends the deliveries of one endpoint in order. Once one of
+// them fails the rest are put back for the same retry time without counting
+// an attempt, an endpoint timing out is not waited on for every delivery.
+func (d Dispatcher) deliverEndpoint(ctx context.Context, deliveries []repository.WebhookDelivery) {
+	l := d.log.With().Str("webhook", "deliverEndpoint").Logger()
+
+	for i, v := range deliveries {
+		failed := d.deliver(ctx, v)
+		if failed == nil {
+			continue
+		}
+
+		msg := "not sent, an earlier delivery to the endpoint failed"
+		for _, rest := range deliveries[i+1:] {
+			rest.NextAttemptAt = *failed
+			rest.LastError = &msg
+			if err := d.store.UpdateWebhookDelivery(ctx, rest); err != nil {
+				l.Error().Err(err).Int64("delivery", rest.ID).Msg("d.store.UpdateWebhookDelivery")
+			}
+		}
+		return
+	}
+}
+
+// deliver sends one delivery and stores its outcome, it returns the time of
+// the next attempt when the delivery failed.
+func (d Dispatcher) deliver(ctx context.Context, delivery repository.WebhookDelivery) *time.Time {
+	l := d.log.With().Str("webhook", "deliver").Int64("delivery", delivery.ID).Logger()
+
+	resp, err := d.http.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader("X-Gophermart-Event", delivery.EventType).
+		SetHeader("X-Gophermart-Delivery", strconv.FormatInt(delivery.ID, 10)).
+		SetHeader("X-Gophermart-Signature", "sha256="+Sign(delivery.Secret, delivery.Payload)).
+		SetBody(delivery.Payload).
+		Post(delivery.URL)
+
+	delivery.Attempts++
+	if err == nil {
+		code := resp.StatusCode()
+		delivery.ResponseCode = &code
+		if resp.IsSuccess() {
+			now := time.Now()
+			delivery.Status = repository.WebhookStatusDelivered
+			delivery.DeliveredAt = &now
+			delivery.LastError = nil
+		} else {
+			err = fmt.Errorf("unexpected status %d", code)
+		}
+	}
+
+	if err != nil {
+		msg := err.Error()
+		delivery.LastError = &msg
+		delivery.NextAttemptAt = time.Now().Add(backoff(delivery.Attempts))
+		if delivery.Attempts >= maxAttempts {
+			delivery.Status = repository.WebhookStatusDead
+		}
+		l.Error().Err(err).Int("attempts", delivery.Attempts).Msg("d.http.Post")
+	}
+
+	if err = d.store.UpdateWebhookDelivery(ctx, delivery); err != nil {
+		l.Error().Err(err).Msg("d.store.UpdateWebhookDelivery")
+	}
+
+	if delivery.Status == repository.WebhookStatusDelivered {
+		return nil
+	}
+	return &delivery.NextAttemptAt
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of the payload, receivers compare it
+// with the X-Gophermart-Signature header.
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func backoff(attempts int) time.Duration {
+	delay := backoffBase << (attempts - 1)
+	if delay <= 0 || delay > backoffMax {
+		return backoffMax
+	}
+	return delay
+}
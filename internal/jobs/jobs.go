@@ -0,0 +1,63 @@
+package jobs
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+type Job struct {
+	Name     string
+	Interval time.Duration
+	// At delays the first run to this time of the day in UTC, zero runs the
+	// job at once.
+	At  time.Duration
+	Run func(context.Context) error
+}
+
+// Sync runs every job once at start, or at its time of the day, and then on
+// its own interval until ctx is done.
+func Sync(ctx context.Context, log zerolog.Logger, jobs ...Job) {
+	for _, j := range jobs {
+		go run(ctx, log, j)
+	}
+}
+
+func run(ctx context.Context, log zerolog.Logger, job Job) {
+	l := log.With().Str("job", job.Name).Logger()
+
+	if job.At > 0 {
+		timer := time.NewTimer(untilTimeOfDay(time.Now().UTC(), job.At))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := job.Run(ctx); err != nil {
+			l.Error().Err(err).Msg("job.Run")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func untilTimeOfDay(now time.Time, at time.Duration) time.Duration {
+	next := now.Truncate(24 * time.Hour).Add(at)
+	if !next.After(now) {
+		next = next.Add(24 * time.Hour)
+	}
+
+	return next.Sub(now)
+}
@@ -0,0 +1,148 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/google/uuid"
+)
+
+const (
+	RoleCustomer = "customer"
+	RoleSupport  = "support"
+	RoleAdmin    = "admin"
+	RoleMerchant = "merchant"
+)
+
+const (
+	PermOrdersRead      = "orders:read"
+	PermOrdersWrite     = "orders:write"
+	PermBalanceRead     = "balance:read"
+	PermBalanceWithdraw = "balance:withdraw"
+	PermUsersRead       = "users:read"
+	PermUsersBlock      = "users:block"
+	PermOrdersRequeue   = "orders:requeue"
+	PermBalanceAdjust   = "balance:adjust"
+	PermAccessManage    = "access:manage"
+	PermWithdrawReverse = "withdrawals:reverse"
+	PermOrdersClawback  = "orders:clawback"
+	PermCampaignsManage = "campaigns:manage"
+	PermWebhooksManage  = "webhooks:manage"
+)
+
+// Permissions lists every permission known to the service.
+var Permissions = []string{
+	PermOrdersRead,
+	PermOrdersWrite,
+	PermBalanceRead,
+	PermBalanceWithdraw,
+	PermUsersRead,
+	PermUsersBlock,
+	PermOrdersRequeue,
+	PermBalanceAdjust,
+	PermAccessManage,
+	PermWithdrawReverse,
+	PermOrdersClawback,
+	PermCampaignsManage,
+	PermWebhooksManage,
+}
+
+// RolePermissions are granted by a role, per user permissions come on top.
+// Merchants get nothing by default, refunding withdrawals is granted to each
+// merchant account explicitly.
+var RolePermissions = map[string][]string{
+	RoleCustomer: {PermOrdersRead, PermOrdersWrite, PermBalanceRead, PermBalanceWithdraw},
+	RoleSupport:  {PermUsersRead, PermOrdersRequeue},
+	RoleAdmin: {
+		PermUsersRead, PermOrdersRequeue, PermUsersBlock, PermBalanceAdjust, PermAccessManage,
+		PermWithdrawReverse, PermOrdersClawback, PermCampaignsManage, PermWebhooksManage,
+	},
+	RoleMerchant: {},
+}
+
+// Principal is the authenticated caller: a user, an operator or a service account.
+type Principal struct {
+	ID          uuid.UUID
+	Name        string
+	Role        string
+	Permissions []string
+}
+
+func (p Principal) Can(perm string) bool {
+	for _, v := range p.Permissions {
+		if v == perm {
+			return true
+		}
+	}
+	return false
+}
+
+type RoleRequest struct {
+	Role        string   `json:"role"`
+	Permissions []string `json:"permissions"`
+}
+
+type APIKeyRequest struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+type APIKey struct {
+	ID          uuid.UUID `json:"id"`
+	Name        string    `json:"name"`
+	Key         string    `json:"key,omitempty"`
+	Permissions []string  `json:"permissions"`
+}
+
+func (req RoleRequest) Validate() error {
+	if _, ok := RolePermissions[req.Role]; !ok {
+		return oops.ErrRoleInvalid
+	}
+
+	return validatePermissions(req.Permissions)
+}
+
+// Validate refuses customer permissions, an API key acts for a service
+// account and owns no orders or balance of its own.
+func (req APIKeyRequest) Validate() error {
+	if strings.TrimSpace(req.Name) == "" || len(req.Permissions) == 0 {
+		return oops.ErrPermissionInvalid
+	}
+
+	if len(ServicePermissions(req.Permissions)) != len(req.Permissions) {
+		return oops.ErrPermissionInvalid
+	}
+
+	return validatePermissions(req.Permissions)
+}
+
+// ServicePermissions drops the customer permissions from perms, keys issued
+// before they were refused keep the rest.
+func ServicePermissions(perms []string) []string {
+	res := make([]string, 0, len(perms))
+	for _, v := range perms {
+		customer := false
+		for _, p := range RolePermissions[RoleCustomer] {
+			customer = customer || p == v
+		}
+		if !customer {
+			res = append(res, v)
+		}
+	}
+
+	return res
+}
+
+func validatePermissions(perms []string) error {
+	for _, v := range perms {
+		known := false
+		for _, p := range Permissions {
+			known = known || p == v
+		}
+		if !known {
+			return oops.ErrPermissionInvalid
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/google/uuid"
+)
+
+type AdminUser struct {
+	ID      uuid.UUID `json:"id"`
+	Login   string    `json:"login"`
+	Blocked bool      `json:"blocked"`
+}
+
+type AdjustmentRequest struct {
+	Amount float32 `json:"amount"`
+	Reason string  `json:"reason"`
+}
+
+func (req AdjustmentRequest) Validate() error {
+	if req.Amount == 0 || strings.TrimSpace(req.Reason) == "" {
+		return oops.ErrAdjustmentInvalid
+	}
+
+	amount := req.Amount
+	if amount < 0 {
+		amount = -amount
+	}
+	if !validSum(amount) {
+		return oops.ErrAdjustmentInvalid
+	}
+
+	return nil
+}
+
+type ClawbackRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (req ClawbackRequest) Validate() error {
+	if strings.TrimSpace(req.Reason) == "" {
+		return oops.ErrValidation
+	}
+
+	return nil
+}
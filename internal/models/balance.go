@@ -1,6 +1,28 @@
 package models
 
+import "time"
+
+// Balance Current is what can be spent, accruals on hold are in Pending.
 type Balance struct {
-	Current   float32 `json:"current"`
+	Current float32 `json:"current"`
+	Pending float32 `json:"pending"`
+	// Held is reserved by holds waiting for capture, it is not in Current.
+	Held      float32 `json:"held,omitempty"`
 	Withdrawn float32 `json:"withdrawn"`
+	// Debt is left by clawbacks the balance could not cover, credits pay it off.
+	Debt float32 `json:"debt,omitempty"`
+	// ExpiringSoon is the part of Current that expires by ExpiringAt.
+	ExpiringSoon float32    `json:"expiring_soon,omitempty"`
+	ExpiringAt   *time.Time `json:"expiring_at,omitempty"`
+}
+
+// PointsExpiry returns when points earned at the given time expire,
+// nil when months is not positive and points never expire.
+func PointsExpiry(earnedAt time.Time, months int) *time.Time {
+	if months <= 0 {
+		return nil
+	}
+
+	t := earnedAt.AddDate(0, months, 0)
+	return &t
 }
@@ -0,0 +1,118 @@
+package models
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/1Asi1/gophermart/internal/oops"
+)
+
+const (
+	// BonusMultiplier credits the accrual once more times BonusValue-1,
+	// 2 doubles the points of the order.
+	BonusMultiplier = "multiplier"
+	// BonusFixed credits BonusValue points.
+	BonusFixed = "fixed"
+)
+
+// Campaign credits a bonus for orders credited within its window that meet
+// every condition set. MinOrders and MaxOrders count the credited orders of
+// the user including this one, MaxOrders 1 means the first order.
+type Campaign struct {
+	ID         int64     `json:"id"`
+	Name       string    `json:"name"`
+	StartsAt   time.Time `json:"starts_at"`
+	EndsAt     time.Time `json:"ends_at"`
+	MinOrders  *int      `json:"min_orders,omitempty"`
+	MaxOrders  *int      `json:"max_orders,omitempty"`
+	MinAccrual *float32  `json:"min_accrual,omitempty"`
+	Tiers      []string  `json:"tiers,omitempty"`
+	BonusType  string    `json:"bonus_type"`
+	BonusValue float32   `json:"bonus_value"`
+	Active     bool      `json:"active"`
+}
+
+type CampaignRequest struct {
+	Name       string    `json:"name"`
+	StartsAt   time.Time `json:"starts_at"`
+	EndsAt     time.Time `json:"ends_at"`
+	MinOrders  *int      `json:"min_orders"`
+	MaxOrders  *int      `json:"max_orders"`
+	MinAccrual *float32  `json:"min_accrual"`
+	Tiers      []string  `json:"tiers"`
+	BonusType  string    `json:"bonus_type"`
+	BonusValue float32   `json:"bonus_value"`
+	Active     *bool     `json:"active"`
+}
+
+// OrderFacts are what campaign conditions are checked against.
+type OrderFacts struct {
+	CreditedAt time.Time
+	Orders     int
+	Accrual    float32
+	Tier       string
+}
+
+func (req CampaignRequest) Validate() error {
+	if strings.TrimSpace(req.Name) == "" || !req.EndsAt.After(req.StartsAt) {
+		return oops.ErrCampaignInvalid
+	}
+
+	if req.BonusType != BonusMultiplier && req.BonusType != BonusFixed {
+		return oops.ErrCampaignInvalid
+	}
+
+	if req.BonusValue <= 0 || (req.BonusType == BonusMultiplier && req.BonusValue <= 1) {
+		return oops.ErrCampaignInvalid
+	}
+
+	if req.MinOrders != nil && *req.MinOrders < 1 || req.MaxOrders != nil && *req.MaxOrders < 1 {
+		return oops.ErrCampaignInvalid
+	}
+
+	if req.MinOrders != nil && req.MaxOrders != nil && *req.MinOrders > *req.MaxOrders {
+		return oops.ErrCampaignInvalid
+	}
+
+	if req.MinAccrual != nil && *req.MinAccrual < 0 {
+		return oops.ErrCampaignInvalid
+	}
+
+	return nil
+}
+
+func (c Campaign) Applies(f OrderFacts) bool {
+	if !c.Active || f.CreditedAt.Before(c.StartsAt) || !f.CreditedAt.Before(c.EndsAt) {
+		return false
+	}
+
+	if c.MinOrders != nil && f.Orders < *c.MinOrders || c.MaxOrders != nil && f.Orders > *c.MaxOrders {
+		return false
+	}
+
+	if c.MinAccrual != nil && f.Accrual < *c.MinAccrual {
+		return false
+	}
+
+	if len(c.Tiers) == 0 {
+		return true
+	}
+	for _, v := range c.Tiers {
+		if v == f.Tier {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Bonus is rounded to the points precision.
+func (c Campaign) Bonus(accrual float32) float32 {
+	bonus := c.BonusValue
+	if c.BonusType == BonusMultiplier {
+		bonus = accrual * (c.BonusValue - 1)
+	}
+
+	return float32(math.Round(float64(bonus)*100) / 100)
+}
@@ -1,14 +1,19 @@
 package models
 
 import (
-	"strconv"
+	"encoding/json"
 	"time"
 
 	"github.com/1Asi1/gophermart/internal/oops"
 	"github.com/google/uuid"
 )
 
-const limit = 9
+const (
+	limit = 9
+
+	minOrderNumberLen = 2
+	maxOrderNumberLen = 64
+)
 
 type OrderRequest struct {
 	UserID uuid.UUID `json:"user_id"`
@@ -22,7 +27,34 @@ type Order struct {
 	UploadedAt time.Time `json:"uploaded_at"`
 }
 
+const (
+	UploadAccepted = "accepted"
+	UploadUploaded = "already_uploaded"
+	UploadConflict = "uploaded_by_another_user"
+	UploadInvalid  = "invalid"
+)
+
+type OrderUpload struct {
+	Number string `json:"number"`
+	Status string `json:"status"`
+}
+
+type OrderEvent struct {
+	PreviousStatus string          `json:"previous_status"`
+	Status         string          `json:"status"`
+	Accrual        *float32        `json:"accrual,omitempty"`
+	Payload        json.RawMessage `json:"payload,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+}
+
+// Validate checks that the number is a string of ASCII digits of sane length
+// passing the Luhn check. Numbers are kept as text, so leading zeros and
+// numbers wider than int64 survive untouched.
 func (req *OrderRequest) Validate() error {
+	if len(req.Number) < minOrderNumberLen || len(req.Number) > maxOrderNumberLen {
+		return oops.ErrLuhnValidate
+	}
+
 	ok := luhnAlgorithm(req.Number)
 	if !ok {
 		return oops.ErrLuhnValidate
@@ -31,12 +63,16 @@ func (req *OrderRequest) Validate() error {
 	return nil
 }
 
+// luhnAlgorithm reports false for anything but ASCII digits.
 func luhnAlgorithm(number string) bool {
 	sum := 0
 	isSecondDigit := false
 
 	for i := len(number) - 1; i >= 0; i-- {
-		digit, _ := strconv.Atoi(string(number[i]))
+		if number[i] < '0' || number[i] > '9' {
+			return false
+		}
+		digit := int(number[i] - '0')
 
 		if isSecondDigit {
 			digit *= 2
@@ -0,0 +1,62 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+// checkDigit is the Luhn check digit of payload computed the textbook way,
+// independently of luhnAlgorithm.
+func checkDigit(payload string) byte {
+	sum := 0
+	for i := 0; i < len(payload); i++ {
+		digit := int(payload[len(payload)-1-i] - '0')
+		if i%2 == 0 {
+			digit *= 2
+			if digit > 9 {
+				digit = digit/10 + digit%10
+			}
+		}
+		sum += digit
+	}
+
+	return byte('0' + (10-sum%10)%10)
+}
+
+func FuzzOrderRequestValidate(f *testing.F) {
+	for _, v := range []string{"7992739871", "237722562", "0", "000000000000000000000000000", "12345678903"} {
+		f.Add(v)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		payload := strings.Map(func(r rune) rune {
+			if r < '0' || r > '9' {
+				return -1
+			}
+			return r
+		}, s)
+		if payload == "" {
+			return
+		}
+		if len(payload) > maxOrderNumberLen-1 {
+			payload = payload[:maxOrderNumberLen-1]
+		}
+
+		check := checkDigit(payload)
+		valid := OrderRequest{Number: payload + string(check)}
+		if err := valid.Validate(); err != nil {
+			t.Fatalf("Validate(%q) = %v, wants nil", valid.Number, err)
+		}
+
+		for d := byte('0'); d <= '9'; d++ {
+			if d == check {
+				continue
+			}
+
+			mutated := OrderRequest{Number: payload + string(d)}
+			if err := mutated.Validate(); err == nil {
+				t.Fatalf("Validate(%q) = nil, wants an error", mutated.Number)
+			}
+		}
+	})
+}
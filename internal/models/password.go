@@ -0,0 +1,43 @@
+package models
+
+import (
+	"errors"
+)
+
+type PasswordChangeRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type PasswordResetRequest struct {
+	Login string `json:"login"`
+}
+
+type PasswordResetConfirm struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+func (req PasswordChangeRequest) Validate() error {
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		return errors.New("empty current or new password")
+	}
+
+	return nil
+}
+
+func (req PasswordResetRequest) Validate() error {
+	if req.Login == "" {
+		return errors.New("empty login")
+	}
+
+	return nil
+}
+
+func (req PasswordResetConfirm) Validate() error {
+	if req.Token == "" || req.NewPassword == "" {
+		return errors.New("empty token or new password")
+	}
+
+	return nil
+}
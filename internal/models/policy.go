@@ -0,0 +1,154 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/1Asi1/gophermart/internal/oops"
+)
+
+const (
+	fieldLogin       = "login"
+	fieldPassword    = "password"
+	fieldNewPassword = "new_password"
+	fieldReferral    = "referral_code"
+)
+
+// commonPasswords is the built-in denylist, Policy.Denylist extends it.
+var commonPasswords = []string{
+	"123456", "12345678", "123456789", "1234567890", "password", "password1",
+	"qwerty", "qwerty123", "qwertyuiop", "111111", "11111111", "000000",
+	"abc123", "iloveyou", "admin", "letmein", "welcome", "monkey", "dragon",
+	"football", "baseball", "sunshine", "princess", "passw0rd", "1q2w3e4r",
+}
+
+type Policy struct {
+	LoginMinLen    int
+	LoginMaxLen    int
+	LoginPattern   *regexp.Regexp
+	PasswordMinLen int
+	PasswordMaxLen int
+	Denylist       map[string]struct{}
+}
+
+func NewPolicy(loginMinLen, loginMaxLen, passwordMinLen int, denylist []string) Policy {
+	p := Policy{
+		LoginMinLen:    loginMinLen,
+		LoginMaxLen:    loginMaxLen,
+		LoginPattern:   regexp.MustCompile(`^[a-z0-9._@+-]+$`),
+		PasswordMinLen: passwordMinLen,
+		PasswordMaxLen: 128,
+		Denylist:       make(map[string]struct{}),
+	}
+
+	for _, v := range append(commonPasswords, denylist...) {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			p.Denylist[v] = struct{}{}
+		}
+	}
+
+	return p
+}
+
+// FieldErrors maps a request field to the reason it was rejected.
+type FieldErrors map[string]string
+
+func (e FieldErrors) Error() string {
+	fields := make([]string, 0, len(e))
+	for k, v := range e {
+		fields = append(fields, k+": "+v)
+	}
+	sort.Strings(fields)
+
+	return strings.Join(fields, "; ")
+}
+
+func (e FieldErrors) Unwrap() error {
+	return oops.ErrValidation
+}
+
+// NormalizeLogin makes logins case-insensitive.
+func NormalizeLogin(login string) string {
+	return strings.ToLower(strings.TrimSpace(login))
+}
+
+func (p Policy) ValidateRegistration(u UserRequest) error {
+	errs := FieldErrors{}
+	if msg := p.checkLogin(u.Login); msg != "" {
+		errs[fieldLogin] = msg
+	}
+	if msg := p.checkPassword(u.Password, u.Login); msg != "" {
+		errs[fieldPassword] = msg
+	}
+	if msg := checkReferralCode(u.ReferralCode); msg != "" {
+		errs[fieldReferral] = msg
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ValidateNewPassword checks a password set by change or reset, the login is
+// unknown on reset and then left empty.
+func (p Policy) ValidateNewPassword(password, login string) error {
+	if msg := p.checkPassword(password, login); msg != "" {
+		return FieldErrors{fieldNewPassword: msg}
+	}
+	return nil
+}
+
+func (p Policy) checkLogin(login string) string {
+	n := utf8.RuneCountInString(login)
+	if n < p.LoginMinLen || n > p.LoginMaxLen {
+		return fmt.Sprintf("must be %d to %d characters long", p.LoginMinLen, p.LoginMaxLen)
+	}
+
+	if p.LoginPattern != nil && !p.LoginPattern.MatchString(login) {
+		return "may contain only latin letters, digits and . _ @ + -"
+	}
+
+	return ""
+}
+
+func (p Policy) checkPassword(password, login string) string {
+	n := utf8.RuneCountInString(password)
+	if n < p.PasswordMinLen || n > p.PasswordMaxLen {
+		return fmt.Sprintf("must be %d to %d characters long", p.PasswordMinLen, p.PasswordMaxLen)
+	}
+
+	lower := strings.ToLower(password)
+	if _, ok := p.Denylist[lower]; ok {
+		return "is too common"
+	}
+
+	if login != "" && lower == strings.ToLower(login) {
+		return "must differ from the login"
+	}
+
+	return ""
+}
+
+// checkReferralCode takes a normalized code, every code given out is made of
+// ReferralCodeAlphabet.
+func checkReferralCode(code string) string {
+	if code == "" {
+		return ""
+	}
+
+	if len(code) != ReferralCodeLen {
+		return fmt.Sprintf("must be %d characters long", ReferralCodeLen)
+	}
+
+	for _, r := range code {
+		if !strings.ContainsRune(ReferralCodeAlphabet, r) {
+			return "may contain only latin letters and digits other than I, O, 0 and 1"
+		}
+	}
+
+	return ""
+}
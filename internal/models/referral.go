@@ -0,0 +1,28 @@
+package models
+
+import "strings"
+
+const (
+	// ReferralCodeLen is the length of the referral code given at registration.
+	ReferralCodeLen = 8
+	// ReferralCodeAlphabet leaves out the characters easy to misread.
+	ReferralCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+const (
+	ReferralRoleReferrer = "referrer"
+	ReferralRoleReferee  = "referee"
+)
+
+// ReferralBonus is credited to both users of a referral once the first order
+// of the referee is processed.
+type ReferralBonus struct {
+	Role  string  `json:"role"`
+	Order string  `json:"order"`
+	Sum   float32 `json:"sum"`
+}
+
+// NormalizeReferralCode makes referral codes case-insensitive.
+func NormalizeReferralCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
@@ -0,0 +1,107 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTiers is used when TIERS is not set.
+const DefaultTiers = "base:0:1"
+
+// Tier is reached by accruing MinAccrued points within the rolling window,
+// accruals are multiplied by Multiplier while the user holds it.
+type Tier struct {
+	Name       string  `json:"name"`
+	MinAccrued float32 `json:"min_accrued"`
+	Multiplier float32 `json:"multiplier"`
+}
+
+// Tiers are sorted by MinAccrued, the first one is the tier of new users.
+type Tiers []Tier
+
+type Profile struct {
+	Login      string    `json:"login"`
+	Role       string    `json:"role"`
+	Tier       string    `json:"tier"`
+	Multiplier float32   `json:"multiplier"`
+	Accrued    float32   `json:"accrued"`
+	Since      time.Time `json:"accrued_since"`
+	NextTier   *Tier     `json:"next_tier,omitempty"`
+
+	// ReferralCode invites other users, Invited counts the users registered
+	// with it and Rewarded those whose first order earned the bonus.
+	ReferralCode string `json:"referral_code"`
+	Invited      int    `json:"invited"`
+	Rewarded     int    `json:"rewarded"`
+}
+
+// ParseTiers reads name:min_accrued:multiplier triples separated by commas.
+func ParseTiers(value string) (Tiers, error) {
+	var tiers Tiers
+	for _, v := range strings.Split(value, ",") {
+		parts := strings.Split(strings.TrimSpace(v), ":")
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid tier %q", v)
+		}
+
+		minAccrued, err := strconv.ParseFloat(parts[1], 32)
+		if err != nil || minAccrued < 0 {
+			return nil, fmt.Errorf("invalid tier %q minimum", v)
+		}
+
+		multiplier, err := strconv.ParseFloat(parts[2], 32)
+		if err != nil || multiplier <= 0 {
+			return nil, fmt.Errorf("invalid tier %q multiplier", v)
+		}
+
+		tiers = append(tiers, Tier{
+			Name:       parts[0],
+			MinAccrued: float32(minAccrued),
+			Multiplier: float32(multiplier),
+		})
+	}
+
+	sort.Slice(tiers, func(i, j int) bool {
+		return tiers[i].MinAccrued < tiers[j].MinAccrued
+	})
+
+	return tiers, nil
+}
+
+// For returns the highest tier reached with the accrued points.
+func (t Tiers) For(accrued float32) Tier {
+	var tier Tier
+	for i, v := range t {
+		if i == 0 || accrued >= v.MinAccrued {
+			tier = v
+		}
+	}
+
+	return tier
+}
+
+// Get returns the tier by name, unknown names get no multiplier.
+func (t Tiers) Get(name string) Tier {
+	for _, v := range t {
+		if v.Name == name {
+			return v
+		}
+	}
+
+	return Tier{Name: name, Multiplier: 1}
+}
+
+// Next returns the tier above the named one, nil for the top tier.
+func (t Tiers) Next(name string) *Tier {
+	for i, v := range t {
+		if v.Name == name && i+1 < len(t) {
+			next := t[i+1]
+			return &next
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/google/uuid"
+)
+
+const (
+	TransferOutgoing = "outgoing"
+	TransferIncoming = "incoming"
+
+	maxTransferCommentLen = 255
+)
+
+type TransferRequest struct {
+	Login   string  `json:"login"`
+	Sum     float32 `json:"sum"`
+	Comment string  `json:"comment"`
+}
+
+// Transfer is seen from the side of the user asking, Login is the other side.
+type Transfer struct {
+	ID        uuid.UUID `json:"id"`
+	Direction string    `json:"direction"`
+	Login     string    `json:"login"`
+	Sum       float32   `json:"sum"`
+	Comment   string    `json:"comment,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (req TransferRequest) Validate() error {
+	if strings.TrimSpace(req.Login) == "" || utf8.RuneCountInString(req.Comment) > maxTransferCommentLen {
+		return oops.ErrTransferInvalid
+	}
+
+	if !validSum(req.Sum) {
+		return oops.ErrWithdrawSumInvalid
+	}
+
+	return nil
+}
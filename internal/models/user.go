@@ -7,6 +7,9 @@ import (
 type UserRequest struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`
+	// ReferralCode is the optional code of the user who invited this one,
+	// registration only.
+	ReferralCode string `json:"referral_code,omitempty"`
 }
 
 func (u UserRequest) Validate() error {
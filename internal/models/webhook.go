@@ -0,0 +1,38 @@
+package models
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/google/uuid"
+)
+
+type WebhookRequest struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+}
+
+// Webhook is a subscription to events, Secret signs the deliveries and is only
+// shown when the subscription is created.
+type Webhook struct {
+	ID         uuid.UUID `json:"id"`
+	URL        string    `json:"url"`
+	Secret     string    `json:"secret,omitempty"`
+	EventTypes []string  `json:"event_types"`
+	Active     bool      `json:"active"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (req WebhookRequest) Validate() error {
+	if len(req.EventTypes) == 0 {
+		return oops.ErrWebhookInvalid
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return oops.ErrWebhookInvalid
+	}
+
+	return nil
+}
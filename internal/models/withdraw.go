@@ -1,16 +1,87 @@
 package models
 
 import (
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/google/uuid"
 )
 
+const sumPrecision = 2
+
+// WithdrawRequest spends Sum on Order, Merchant is the optional merchant
+// account the order is placed with. That merchant may refund the withdrawal.
 type WithdrawRequest struct {
-	Order string  `json:"order"`
-	Sum   float32 `json:"sum"`
+	Order    string     `json:"order"`
+	Sum      float32    `json:"sum"`
+	Merchant *uuid.UUID `json:"merchant,omitempty"`
 }
 
 type Withdraw struct {
 	Order       string    `json:"order"`
 	Sum         float32   `json:"sum"`
+	Status      string    `json:"status,omitempty"`
+	Reversed    float32   `json:"reversed,omitempty"`
 	ProcessedAt time.Time `json:"processed_at"`
 }
+
+// Hold reserves Sum for Order until it is captured as a withdrawal, voided
+// or expires.
+type Hold struct {
+	ID        uuid.UUID  `json:"id"`
+	Order     string     `json:"order"`
+	Sum       float32    `json:"sum"`
+	Status    string     `json:"status"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	ClosedAt  *time.Time `json:"closed_at,omitempty"`
+}
+
+// ReversalRequest refunds Sum of a withdrawal, zero refunds what is left of it.
+type ReversalRequest struct {
+	Sum    float32 `json:"sum"`
+	Reason string  `json:"reason"`
+}
+
+func (req WithdrawRequest) Validate() error {
+	order := OrderRequest{Number: req.Order}
+	if err := order.Validate(); err != nil {
+		return oops.ErrOrderNumberInvalid
+	}
+
+	if req.Sum <= 0 {
+		return oops.ErrWithdrawSumInvalid
+	}
+
+	if !validSum(req.Sum) {
+		return oops.ErrWithdrawSumInvalid
+	}
+
+	return nil
+}
+
+func (req ReversalRequest) Validate() error {
+	if strings.TrimSpace(req.Reason) == "" {
+		return oops.ErrReversalInvalid
+	}
+
+	if req.Sum != 0 && !validSum(req.Sum) {
+		return oops.ErrReversalInvalid
+	}
+
+	return nil
+}
+
+// validSum reports whether a positive sum has at most sumPrecision decimal
+// places. Points are kopeck-precise, more would be silently rounded.
+func validSum(sum float32) bool {
+	if sum <= 0 {
+		return false
+	}
+
+	v := strconv.FormatFloat(float64(sum), 'f', -1, 32)
+	i := strings.IndexByte(v, '.')
+	return i < 0 || len(v)-i-1 <= sumPrecision
+}
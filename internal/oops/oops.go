@@ -1,15 +1,64 @@
 package oops
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 var (
 	ErrOrderCreate           = errors.New("new order number accepted for processing")
 	ErrOrderReady            = errors.New("the order number has already been uploaded by another user")
 	ErrOrderNumberInvalid    = errors.New("invalid order number")
 	ErrInsufficientFunds     = errors.New("insufficient funds")
+	ErrWithdrawSumInvalid    = errors.New("invalid withdrawal sum")
+	ErrWithdrawExists        = errors.New("withdrawal for the order already exists")
 	ErrEmptyData             = errors.New("no result")
 	ErrLuhnValidate          = errors.New("invalid order format")
 	ErrStatusNotOK           = errors.New("status not ok")
 	ErrStatusTooManyRequests = errors.New("status too many requests")
 	ErrInvalidToken          = errors.New("token invalid")
+	ErrLoginTaken            = errors.New("login already taken")
+	ErrUserNotFound          = errors.New("user not found")
+	ErrUserBlocked           = errors.New("user blocked")
+	ErrOrderProcessed        = errors.New("order already processed")
+	ErrOrderCredited         = errors.New("order already credited")
+	ErrAdjustmentInvalid     = errors.New("invalid balance adjustment")
+	ErrRoleInvalid           = errors.New("invalid role")
+	ErrPermissionInvalid     = errors.New("invalid permission")
+	ErrIdempotencyKeyReused  = errors.New("idempotency key reused with a different request")
+	ErrIdempotencyInProgress = errors.New("request with this idempotency key is in progress")
+	ErrInvalidCredentials    = errors.New("invalid login or password")
+	ErrTooManyAttempts       = errors.New("too many login attempts")
+	ErrValidation            = errors.New("validation failed")
+	ErrAccountNotFound       = errors.New("balance account not found")
+	ErrWithdrawalNotFound    = errors.New("withdrawal not found")
+	ErrMerchantNotFound      = errors.New("merchant not found")
+	ErrReversalInvalid       = errors.New("invalid withdrawal reversal")
+	ErrClawbackInvalid       = errors.New("order already cancelled")
+	ErrHoldNotFound          = errors.New("hold not found")
+	ErrHoldNotActive         = errors.New("hold is not authorized")
+	ErrHoldExists            = errors.New("hold for the order already exists")
+	ErrTransferInvalid       = errors.New("invalid transfer")
+	ErrTransferLimit         = errors.New("daily transfer limit exceeded")
+	ErrTransferExists        = errors.New("transfer with this idempotency key already exists")
+	ErrCampaignInvalid       = errors.New("invalid campaign")
+	ErrCampaignNotFound      = errors.New("campaign not found")
+	ErrReferralInvalid       = errors.New("invalid referral code")
+	ErrReferralCodeTaken     = errors.New("referral code already taken")
+	ErrWebhookInvalid        = errors.New("invalid webhook")
+	ErrWebhookNotFound       = errors.New("webhook not found")
+	ErrBalanceDrift          = errors.New("balance does not match its point lots")
 )
+
+// LockedError is ErrTooManyAttempts carrying the time left until the lock expires.
+type LockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e LockedError) Error() string {
+	return ErrTooManyAttempts.Error()
+}
+
+func (e LockedError) Unwrap() error {
+	return ErrTooManyAttempts
+}
@@ -0,0 +1,155 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/google/uuid"
+)
+
+type APIKey struct {
+	ID          uuid.UUID  `db:"id"`
+	Name        string     `db:"name"`
+	KeyHash     string     `db:"key_hash"`
+	Permissions TextArray  `db:"permissions"`
+	CreatedBy   string     `db:"created_by"`
+	CreatedAt   time.Time  `db:"created_at"`
+	RevokedAt   *time.Time `db:"revoked_at"`
+}
+
+func (s Store) SetRole(
+	ctx context.Context,
+	id uuid.UUID,
+	role string,
+	permissions []string,
+	audit Audit[uuid.UUID],
+) error {
+	tx, err := s.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("s.BeginTxx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	query := `
+	UPDATE users
+	SET role=$1,permissions=$2
+	WHERE id=$3`
+
+	res, err := tx.ExecContext(ctx, query, role, TextArray(permissions), id)
+	if err != nil {
+		return fmt.Errorf("tx.ExecContext: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("res.RowsAffected(): %w", err)
+	}
+
+	if n == 0 {
+		return oops.ErrUserNotFound
+	}
+
+	if err = addAuditLog(ctx, tx, audit, id); err != nil {
+		return fmt.Errorf("addAuditLog: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit: %w", err)
+	}
+
+	return nil
+}
+
+func (s Store) CreateAPIKey(ctx context.Context, key APIKey, audit Audit[APIKey]) error {
+	tx, err := s.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("s.BeginTxx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	query := `
+	INSERT INTO api_keys(id,name,key_hash,permissions,created_by,created_at)
+	VALUES ($1,$2,$3,$4,$5,NOW())`
+
+	_, err = tx.ExecContext(ctx, query, key.ID, key.Name, key.KeyHash, key.Permissions, key.CreatedBy)
+	if err != nil {
+		return fmt.Errorf("tx.ExecContext: %w", err)
+	}
+
+	if err = addAuditLog(ctx, tx, audit, key); err != nil {
+		return fmt.Errorf("addAuditLog: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit: %w", err)
+	}
+
+	return nil
+}
+
+func (s Store) CheckAPIKey(ctx context.Context, hash string) (APIKey, error) {
+	query := `
+	SELECT
+	    id,
+	    name,
+	    permissions
+	FROM api_keys
+	WHERE key_hash=$1 AND revoked_at IS NULL`
+
+	var keys []APIKey
+	err := s.SelectContext(ctx, &keys, query, hash)
+	if err != nil {
+		return APIKey{}, fmt.Errorf("s.SelectContext: %w", err)
+	}
+
+	if keys == nil {
+		return APIKey{}, oops.ErrInvalidToken
+	}
+
+	return keys[0], nil
+}
+
+func (s Store) RevokeAPIKey(ctx context.Context, id uuid.UUID, audit Audit[uuid.UUID]) error {
+	tx, err := s.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("s.BeginTxx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	query := `
+	UPDATE api_keys
+	SET revoked_at=NOW()
+	WHERE id=$1 AND revoked_at IS NULL`
+
+	res, err := tx.ExecContext(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("tx.ExecContext: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("res.RowsAffected(): %w", err)
+	}
+
+	if n == 0 {
+		return oops.ErrEmptyData
+	}
+
+	if err = addAuditLog(ctx, tx, audit, id); err != nil {
+		return fmt.Errorf("addAuditLog: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,281 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+const searchUsersLimit = 50
+
+type Adjustment struct {
+	UserID    uuid.UUID `db:"user_id"`
+	Amount    float32   `db:"amount"`
+	Reason    string    `db:"reason"`
+	Operator  string    `db:"operator"`
+	CreatedAt time.Time `db:"created_at"`
+	// ExpiresAt applies to a credit, debits consume the oldest lots.
+	ExpiresAt *time.Time `db:"-"`
+}
+
+type AuditLog struct {
+	Operator string     `db:"operator"`
+	Action   string     `db:"action"`
+	UserID   *uuid.UUID `db:"user_id"`
+	Details  []byte     `db:"details"`
+}
+
+func (s Store) SearchUsers(ctx context.Context, login string) ([]User, error) {
+	query := `
+	SELECT
+	    id,
+	    login,
+	    blocked
+	FROM users
+	WHERE login ILIKE $1 ESCAPE '\'
+	ORDER BY login
+	LIMIT $2`
+
+	pattern := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(login) + "%"
+
+	var users []User
+	err := s.SelectContext(ctx, &users, query, pattern, searchUsersLimit)
+	if err != nil {
+		return nil, fmt.Errorf("s.SelectContext: %w", err)
+	}
+
+	if users == nil {
+		return nil, oops.ErrEmptyData
+	}
+
+	return users, nil
+}
+
+func (s Store) SetBlocked(ctx context.Context, id uuid.UUID, blocked bool, audit Audit[uuid.UUID]) error {
+	tx, err := s.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("s.BeginTxx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	query := `
+	UPDATE users
+	SET blocked=$1
+	WHERE id=$2`
+
+	res, err := tx.ExecContext(ctx, query, blocked, id)
+	if err != nil {
+		return fmt.Errorf("tx.ExecContext: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("res.RowsAffected(): %w", err)
+	}
+
+	if n == 0 {
+		return oops.ErrUserNotFound
+	}
+
+	if err = addAuditLog(ctx, tx, audit, id); err != nil {
+		return fmt.Errorf("addAuditLog: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit: %w", err)
+	}
+
+	return nil
+}
+
+// RequeueOrder puts an order that has not been credited yet back to NEW so the
+// poller checks it again, the reset is added to the order history.
+func (s Store) RequeueOrder(ctx context.Context, number string, audit Audit[Order]) (Order, error) {
+	tx, err := s.BeginTxx(ctx, nil)
+	if err != nil {
+		return Order{}, fmt.Errorf("s.BeginTxx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	queryOrder := `
+	SELECT
+	    user_id,
+	    number,
+	    status,
+	    accrual,
+	    uploaded_at,
+	    checked
+	FROM orders
+	WHERE number=$1
+	FOR UPDATE`
+
+	var order Order
+	err = tx.GetContext(ctx, &order, queryOrder, number)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Order{}, oops.ErrEmptyData
+		}
+		return Order{}, fmt.Errorf("tx.GetContext: %w", err)
+	}
+
+	if order.Checked {
+		return Order{}, oops.ErrOrderProcessed
+	}
+
+	query := `
+	UPDATE orders
+	SET status=$1
+	WHERE number=$2`
+
+	_, err = tx.ExecContext(ctx, query, OrderStatusNew, number)
+	if err != nil {
+		return Order{}, fmt.Errorf("tx.ExecContext: %w", err)
+	}
+
+	err = addOrderEvent(ctx, tx, OrderEvent{
+		UserID:         order.UserID,
+		Number:         order.Number,
+		PreviousStatus: order.Status,
+		Status:         OrderStatusNew,
+		Accrual:        order.Accrual,
+	})
+	if err != nil {
+		return Order{}, fmt.Errorf("addOrderEvent: %w", err)
+	}
+
+	order.Status = OrderStatusNew
+	if err = addAuditLog(ctx, tx, audit, order); err != nil {
+		return Order{}, fmt.Errorf("addAuditLog: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Order{}, fmt.Errorf("tx.Commit: %w", err)
+	}
+
+	return order, nil
+}
+
+// AdjustBalance applies a signed manual adjustment and records it in one transaction.
+func (s Store) AdjustBalance(ctx context.Context, adj Adjustment, audit Audit[Balance]) (Balance, error) {
+	tx, err := s.BeginTxx(ctx, nil)
+	if err != nil {
+		return Balance{}, fmt.Errorf("s.BeginTxx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	queryBalance := `
+	UPDATE balances
+	SET current=current+$1
+	WHERE user_id=$2
+	RETURNING user_id, current, pending, held, withdrawn, debt`
+
+	var balances []Balance
+	err = tx.SelectContext(ctx, &balances, queryBalance, adj.Amount, adj.UserID)
+	if err != nil {
+		return Balance{}, fmt.Errorf("tx.SelectContext: %w", constraintError(err))
+	}
+
+	if balances == nil {
+		return Balance{}, oops.ErrUserNotFound
+	}
+
+	if adj.Amount > 0 {
+		err = addLot(ctx, tx, PointLot{
+			UserID:    adj.UserID,
+			Source:    LotSourceAdjustment,
+			Amount:    adj.Amount,
+			ExpiresAt: adj.ExpiresAt,
+		})
+		if err != nil {
+			return Balance{}, fmt.Errorf("addLot: %w", err)
+		}
+
+		balances[0], err = settleDebt(ctx, tx, adj.UserID)
+		if err != nil {
+			return Balance{}, fmt.Errorf("settleDebt: %w", err)
+		}
+	} else {
+		if _, err = consumeLots(ctx, tx, adj.UserID, -adj.Amount); err != nil {
+			return Balance{}, fmt.Errorf("consumeLots: %w", err)
+		}
+	}
+
+	queryAdjustment := `
+	INSERT INTO balance_adjustments(user_id,amount,reason,operator,created_at)
+	VALUES ($1,$2,$3,$4,NOW())`
+
+	_, err = tx.ExecContext(ctx, queryAdjustment, adj.UserID, adj.Amount, adj.Reason, adj.Operator)
+	if err != nil {
+		return Balance{}, fmt.Errorf("tx.ExecContext: %w", constraintError(err))
+	}
+
+	if err = addAuditLog(ctx, tx, audit, balances[0]); err != nil {
+		return Balance{}, fmt.Errorf("addAuditLog: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Balance{}, fmt.Errorf("tx.Commit: %w", err)
+	}
+
+	return balances[0], nil
+}
+
+// Audit builds the audit log entry of an operator change from its result. The
+// store writes it in the transaction of the change, so a change is never made
+// without its entry. A nil Audit writes nothing.
+type Audit[T any] func(T) (AuditLog, error)
+
+func addAuditLog[T any](ctx context.Context, tx *sqlx.Tx, audit Audit[T], result T) error {
+	if audit == nil {
+		return nil
+	}
+
+	entry, err := audit(result)
+	if err != nil {
+		return fmt.Errorf("audit: %w", err)
+	}
+
+	query := `
+	INSERT INTO audit_log(operator,action,user_id,details,created_at)
+	VALUES ($1,$2,$3,NULLIF($4,'')::jsonb,NOW())`
+
+	_, err = tx.ExecContext(ctx, query, entry.Operator, entry.Action, entry.UserID, string(entry.Details))
+	if err != nil {
+		return fmt.Errorf("tx.ExecContext: %w", err)
+	}
+
+	return nil
+}
+
+// CreateAuditLog records an operator action that changes nothing, changes are
+// audited in their own transaction.
+func (s Store) CreateAuditLog(ctx context.Context, entry AuditLog) error {
+	query := `
+	INSERT INTO audit_log(operator,action,user_id,details,created_at)
+	VALUES ($1,$2,$3,NULLIF($4,'')::jsonb,NOW())`
+
+	res, err := s.ExecContext(ctx, query, entry.Operator, entry.Action, entry.UserID, string(entry.Details))
+	if err != nil {
+		return fmt.Errorf("s.ExecContext: %w", err)
+	}
+
+	_, err = res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("res.RowsAffected(): %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,272 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/jmoiron/sqlx"
+)
+
+const LotSourceBonus = "bonus"
+
+type Campaign struct {
+	ID         int64     `db:"id"`
+	Name       string    `db:"name"`
+	StartsAt   time.Time `db:"starts_at"`
+	EndsAt     time.Time `db:"ends_at"`
+	MinOrders  *int      `db:"min_orders"`
+	MaxOrders  *int      `db:"max_orders"`
+	MinAccrual *float32  `db:"min_accrual"`
+	Tiers      TextArray `db:"tiers"`
+	BonusType  string    `db:"bonus_type"`
+	BonusValue float32   `db:"bonus_value"`
+	Active     bool      `db:"active"`
+	CreatedBy  string    `db:"created_by"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+// Bonus is what a campaign adds to the accrual of an order.
+type Bonus struct {
+	CampaignID int64
+	Amount     float32
+}
+
+// Bonuses evaluates the campaigns for an order, orders is how many orders of
+// the user are credited counting this one.
+type Bonuses func(orders int) ([]Bonus, error)
+
+const queryCampaigns = `
+	SELECT
+	    id,
+	    name,
+	    starts_at,
+	    ends_at,
+	    min_orders,
+	    max_orders,
+	    min_accrual,
+	    tiers,
+	    bonus_type,
+	    bonus_value,
+	    active,
+	    created_by,
+	    created_at
+	FROM campaigns`
+
+// ActiveCampaigns returns the active campaigns running at the given time.
+func (s Store) ActiveCampaigns(ctx context.Context, at time.Time) ([]Campaign, error) {
+	query := queryCampaigns + `
+	WHERE active AND starts_at<=$1 AND ends_at>$1
+	ORDER BY id`
+
+	var campaigns []Campaign
+	err := s.SelectContext(ctx, &campaigns, query, at)
+	if err != nil {
+		return nil, fmt.Errorf("s.SelectContext: %w", err)
+	}
+
+	return campaigns, nil
+}
+
+func (s Store) Campaigns(ctx context.Context) ([]Campaign, error) {
+	query := queryCampaigns + `
+	ORDER BY starts_at DESC, id DESC`
+
+	var campaigns []Campaign
+	err := s.SelectContext(ctx, &campaigns, query)
+	if err != nil {
+		return nil, fmt.Errorf("s.SelectContext: %w", err)
+	}
+
+	if campaigns == nil {
+		return nil, oops.ErrEmptyData
+	}
+
+	return campaigns, nil
+}
+
+func (s Store) CreateCampaign(ctx context.Context, c Campaign, audit Audit[Campaign]) (Campaign, error) {
+	tx, err := s.BeginTxx(ctx, nil)
+	if err != nil {
+		return Campaign{}, fmt.Errorf("s.BeginTxx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	query := `
+	INSERT INTO campaigns(name,starts_at,ends_at,min_orders,max_orders,min_accrual,tiers,bonus_type,bonus_value,active,created_by,created_at)
+	VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,NOW())
+	RETURNING id, name, starts_at, ends_at, min_orders, max_orders, min_accrual, tiers, bonus_type, bonus_value,
+	    active, created_by, created_at`
+
+	var campaign Campaign
+	err = tx.GetContext(ctx, &campaign, query,
+		c.Name, c.StartsAt, c.EndsAt, c.MinOrders, c.MaxOrders, c.MinAccrual, c.Tiers, c.BonusType, c.BonusValue,
+		c.Active, c.CreatedBy)
+	if err != nil {
+		return Campaign{}, fmt.Errorf("tx.GetContext: %w", err)
+	}
+
+	if err = addAuditLog(ctx, tx, audit, campaign); err != nil {
+		return Campaign{}, fmt.Errorf("addAuditLog: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Campaign{}, fmt.Errorf("tx.Commit: %w", err)
+	}
+
+	return campaign, nil
+}
+
+// UpdateCampaign replaces the rules of the campaign, bonuses already credited
+// stay as they are.
+func (s Store) UpdateCampaign(ctx context.Context, c Campaign, audit Audit[Campaign]) (Campaign, error) {
+	tx, err := s.BeginTxx(ctx, nil)
+	if err != nil {
+		return Campaign{}, fmt.Errorf("s.BeginTxx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	query := `
+	UPDATE campaigns
+	SET
+	    name=$1,
+	    starts_at=$2,
+	    ends_at=$3,
+	    min_orders=$4,
+	    max_orders=$5,
+	    min_accrual=$6,
+	    tiers=$7,
+	    bonus_type=$8,
+	    bonus_value=$9,
+	    active=$10
+	WHERE id=$11
+	RETURNING id, name, starts_at, ends_at, min_orders, max_orders, min_accrual, tiers, bonus_type, bonus_value,
+	    active, created_by, created_at`
+
+	var campaign Campaign
+	err = tx.GetContext(ctx, &campaign, query,
+		c.Name, c.StartsAt, c.EndsAt, c.MinOrders, c.MaxOrders, c.MinAccrual, c.Tiers, c.BonusType, c.BonusValue,
+		c.Active, c.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Campaign{}, oops.ErrCampaignNotFound
+		}
+		return Campaign{}, fmt.Errorf("tx.GetContext: %w", err)
+	}
+
+	if err = addAuditLog(ctx, tx, audit, campaign); err != nil {
+		return Campaign{}, fmt.Errorf("addAuditLog: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Campaign{}, fmt.Errorf("tx.Commit: %w", err)
+	}
+
+	return campaign, nil
+}
+
+func (s Store) DeactivateCampaign(ctx context.Context, id int64, audit Audit[int64]) error {
+	tx, err := s.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("s.BeginTxx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	query := `
+	UPDATE campaigns
+	SET active=false
+	WHERE id=$1`
+
+	res, err := tx.ExecContext(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("tx.ExecContext: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("res.RowsAffected(): %w", err)
+	}
+
+	if n == 0 {
+		return oops.ErrCampaignNotFound
+	}
+
+	if err = addAuditLog(ctx, tx, audit, id); err != nil {
+		return fmt.Errorf("addAuditLog: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit: %w", err)
+	}
+
+	return nil
+}
+
+// creditedOrders counts the other orders of the user whose accrual was
+// credited and not clawed back. It must run under the balance lock of the
+// user, so concurrent credits of one user never count the same orders.
+func creditedOrders(ctx context.Context, tx *sqlx.Tx, order Order) (int, error) {
+	query := `
+	SELECT
+	    count(*)
+	FROM orders
+	WHERE user_id=$1 AND number<>$2 AND checked AND status='PROCESSED'`
+
+	var count int
+	err := tx.GetContext(ctx, &count, query, order.UserID, order.Number)
+	if err != nil {
+		return 0, fmt.Errorf("tx.GetContext: %w", err)
+	}
+
+	return count, nil
+}
+
+// addBonuses records the campaign bonuses of the order, each one as a lot of
+// its own next to the accrual lot and on the same terms. It must run in the
+// transaction that credits the balance with the bonuses.
+func addBonuses(ctx context.Context, tx *sqlx.Tx, order Order, lot PointLot, bonuses []Bonus) error {
+	query := `
+	INSERT INTO campaign_bonuses(campaign_id,user_id,number,amount,created_at)
+	VALUES ($1,$2,$3,$4,NOW())`
+
+	for _, v := range bonuses {
+		_, err := tx.ExecContext(ctx, query, v.CampaignID, order.UserID, order.Number, v.Amount)
+		if err != nil {
+			return fmt.Errorf("tx.ExecContext: %w", err)
+		}
+
+		lot.Source = LotSourceBonus
+		lot.Amount = v.Amount
+		if err = addLot(ctx, tx, lot); err != nil {
+			return fmt.Errorf("addLot: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// orderBonuses sums the campaign bonuses credited for the order.
+func orderBonuses(ctx context.Context, tx *sqlx.Tx, number string) (float32, error) {
+	query := `
+	SELECT
+	    COALESCE(sum(amount), 0)
+	FROM campaign_bonuses
+	WHERE number=$1`
+
+	var sum float32
+	err := tx.GetContext(ctx, &sum, query, number)
+	if err != nil {
+		return 0, fmt.Errorf("tx.GetContext: %w", err)
+	}
+
+	return sum, nil
+}
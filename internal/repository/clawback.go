@@ -0,0 +1,257 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	OrderStatusNew       = "NEW"
+	OrderStatusCancelled = "CANCELLED"
+)
+
+// Clawback cancels the order with Number. Payload is kept in the order
+// history next to the cancellation.
+type Clawback struct {
+	Number  string
+	Payload []byte
+}
+
+// Clawed is the order as it was before the cancellation with the amount taken
+// back, zero when nothing was credited for it.
+type Clawed struct {
+	Order  Order
+	Amount float32
+}
+
+// ClawbackOrder cancels the order and takes back the accrual credited for it
+// with its campaign bonuses. The order lots go first, then the oldest available
+// lots, and whatever the balance cannot cover is recorded as debt. A referral
+// rewarded for the order is taken back from both users and may be earned again
+// by a later order. It returns the order as it was before the cancellation,
+// the new balance and the amount taken back from the user.
+func (s Store) ClawbackOrder(
+	ctx context.Context,
+	cb Clawback,
+	notify Notify[Clawed],
+	audit Audit[Clawed],
+) (Order, Balance, float32, error) {
+	tx, err := s.BeginTxx(ctx, nil)
+	if err != nil {
+		return Order{}, Balance{}, 0, fmt.Errorf("s.BeginTxx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	queryOrder := `
+	SELECT
+	    user_id,
+	    number,
+	    status,
+	    accrual,
+	    uploaded_at,
+	    checked
+	FROM orders
+	WHERE number=$1
+	FOR UPDATE`
+
+	var order Order
+	err = tx.GetContext(ctx, &order, queryOrder, cb.Number)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Order{}, Balance{}, 0, oops.ErrEmptyData
+		}
+		return Order{}, Balance{}, 0, fmt.Errorf("tx.GetContext: %w", err)
+	}
+
+	if order.Status == OrderStatusCancelled {
+		return Order{}, Balance{}, 0, oops.ErrClawbackInvalid
+	}
+
+	var referral Referral
+	var rewarded bool
+	if order.Checked && order.Accrual != nil {
+		referral, rewarded, err = orderReferral(ctx, tx, order)
+		if err != nil {
+			return Order{}, Balance{}, 0, fmt.Errorf("orderReferral: %w", err)
+		}
+	}
+
+	// Both balances are locked in the order of their ids like in RewardReferral.
+	if rewarded && referral.ReferrerID.String() < order.UserID.String() {
+		if _, err = lockBalance(ctx, tx, referral.ReferrerID); err != nil {
+			return Order{}, Balance{}, 0, fmt.Errorf("lockBalance: %w", err)
+		}
+	}
+
+	balance, err := lockBalance(ctx, tx, order.UserID)
+	if err != nil {
+		return Order{}, Balance{}, 0, fmt.Errorf("lockBalance: %w", err)
+	}
+
+	var amount float32
+	if order.Checked && order.Accrual != nil {
+		bonuses, err := orderBonuses(ctx, tx, order.Number)
+		if err != nil {
+			return Order{}, Balance{}, 0, fmt.Errorf("orderBonuses: %w", err)
+		}
+
+		amount = roundCents(*order.Accrual + bonuses + referral.Amount)
+		balance, err = takeBack(ctx, tx, order, amount, balance)
+		if err != nil {
+			return Order{}, Balance{}, 0, fmt.Errorf("takeBack: %w", err)
+		}
+	}
+
+	if rewarded {
+		if err = takeBackReferral(ctx, tx, order, referral); err != nil {
+			return Order{}, Balance{}, 0, fmt.Errorf("takeBackReferral: %w", err)
+		}
+	}
+
+	queryCancel := `
+	UPDATE orders
+	SET status=$1,checked=true
+	WHERE number=$2`
+
+	_, err = tx.ExecContext(ctx, queryCancel, OrderStatusCancelled, order.Number)
+	if err != nil {
+		return Order{}, Balance{}, 0, fmt.Errorf("tx.ExecContext: %w", err)
+	}
+
+	// A debit is logged with a negative accrual, nil when nothing was credited.
+	var debit *float32
+	if amount > 0 {
+		v := -amount
+		debit = &v
+	}
+
+	err = addOrderEvent(ctx, tx, OrderEvent{
+		UserID:         order.UserID,
+		Number:         order.Number,
+		PreviousStatus: order.Status,
+		Status:         OrderStatusCancelled,
+		Accrual:        debit,
+		Payload:        cb.Payload,
+	})
+	if err != nil {
+		return Order{}, Balance{}, 0, fmt.Errorf("addOrderEvent: %w", err)
+	}
+
+	clawed := Clawed{Order: order, Amount: amount}
+	if err = enqueueWebhooks(ctx, tx, notify, clawed); err != nil {
+		return Order{}, Balance{}, 0, fmt.Errorf("enqueueWebhooks: %w", err)
+	}
+
+	if err = addAuditLog(ctx, tx, audit, clawed); err != nil {
+		return Order{}, Balance{}, 0, fmt.Errorf("addAuditLog: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Order{}, Balance{}, 0, fmt.Errorf("tx.Commit: %w", err)
+	}
+
+	return order, balance, amount, nil
+}
+
+// takeBack debits the amount credited for the order from the locked balance.
+// It fails with oops.ErrBalanceDrift when the balance holds less than the
+// order lots, the ledger must be repaired rather than the difference dropped.
+func takeBack(ctx context.Context, tx *sqlx.Tx, order Order, amount float32, balance Balance) (Balance, error) {
+	queryLots := `
+	WITH own AS (
+		SELECT
+		    id,
+		    remaining,
+		    pending
+		FROM point_lots
+		WHERE user_id=$1 AND number=$2 AND source=ANY($3::text[]) AND remaining > 0
+	), updated AS (
+		UPDATE point_lots l
+		SET remaining=0
+		FROM own o
+		WHERE l.id=o.id
+	)
+	SELECT
+	    COALESCE(sum(remaining) FILTER (WHERE pending), 0) AS pending,
+	    COALESCE(sum(remaining) FILTER (WHERE NOT pending), 0) AS current
+	FROM own`
+
+	var own Balance
+	err := tx.GetContext(ctx, &own, queryLots,
+		order.UserID, order.Number, TextArray{LotSourceAccrual, LotSourceBonus, LotSourceReferral})
+	if err != nil {
+		return Balance{}, fmt.Errorf("tx.GetContext: %w", err)
+	}
+
+	if cents(own.Current) > cents(balance.Current) || cents(own.Pending) > cents(balance.Pending) {
+		return Balance{}, fmt.Errorf("%w: order lots hold %.2f current and %.2f pending, the balance %.2f and %.2f",
+			oops.ErrBalanceDrift, own.Current, own.Pending, balance.Current, balance.Pending)
+	}
+
+	owed := roundCents(amount - own.Pending - own.Current)
+	if owed < 0 {
+		owed = 0
+	}
+
+	fromCurrent := owed
+	if available := balance.Current - own.Current; available < fromCurrent {
+		fromCurrent = available
+	}
+	fromCurrent = roundCents(fromCurrent)
+
+	if fromCurrent > 0 {
+		if _, err = consumeLots(ctx, tx, order.UserID, fromCurrent); err != nil {
+			return Balance{}, fmt.Errorf("consumeLots: %w", err)
+		}
+	}
+
+	queryBalance := `
+	UPDATE balances
+	SET
+	    current=current-$1,
+	    pending=pending-$2,
+	    debt=debt+$3
+	WHERE user_id=$4
+	RETURNING user_id, current, pending, held, withdrawn, debt`
+
+	err = tx.GetContext(ctx, &balance, queryBalance,
+		own.Current+fromCurrent, own.Pending, owed-fromCurrent, order.UserID)
+	if err != nil {
+		return Balance{}, fmt.Errorf("tx.GetContext: %w", err)
+	}
+
+	return balance, nil
+}
+
+// HeldOrders returns processed orders whose accrual is still on hold, the
+// accrual system may cancel them until the hold is over.
+func (s Store) HeldOrders(ctx context.Context) ([]Order, error) {
+	query := `
+	SELECT
+	    o.user_id,
+	    o.number,
+	    o.status,
+	    o.accrual,
+	    o.uploaded_at,
+	    o.checked
+	FROM orders o
+	WHERE o.status='PROCESSED' AND EXISTS (
+		SELECT 1 FROM point_lots l WHERE l.number=o.number AND l.source=$1 AND l.pending
+	)
+	ORDER BY o.uploaded_at`
+
+	var orders []Order
+	err := s.SelectContext(ctx, &orders, query, LotSourceAccrual)
+	if err != nil {
+		return nil, fmt.Errorf("s.SelectContext: %w", err)
+	}
+
+	return orders, nil
+}
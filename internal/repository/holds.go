@@ -0,0 +1,331 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	HoldStatusAuthorized = "authorized"
+	HoldStatusCaptured   = "captured"
+	HoldStatusVoided     = "voided"
+	HoldStatusExpired    = "expired"
+)
+
+type Hold struct {
+	ID         uuid.UUID  `db:"id"`
+	UserID     uuid.UUID  `db:"user_id"`
+	Number     string     `db:"number"`
+	Sum        float32    `db:"sum"`
+	MerchantID *uuid.UUID `db:"merchant_id"`
+	Status     string     `db:"status"`
+	CreatedAt  time.Time  `db:"created_at"`
+	ExpiresAt  time.Time  `db:"expires_at"`
+	ClosedAt   *time.Time `db:"closed_at"`
+}
+
+// AuthorizeHold reserves the sum for the order: it leaves current for held
+// and the lots it was taken from are remembered, so a void puts the points
+// back where they came from.
+func (s Store) AuthorizeHold(ctx context.Context, hold Hold) (Hold, Balance, error) {
+	tx, err := s.BeginTxx(ctx, nil)
+	if err != nil {
+		return Hold{}, Balance{}, fmt.Errorf("s.BeginTxx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	balance, err := lockBalance(ctx, tx, hold.UserID)
+	if err != nil {
+		return Hold{}, Balance{}, fmt.Errorf("lockBalance: %w", err)
+	}
+
+	if balance.Current < hold.Sum {
+		return Hold{}, Balance{}, oops.ErrInsufficientFunds
+	}
+
+	if err = lockNumber(ctx, tx, hold.Number); err != nil {
+		return Hold{}, Balance{}, fmt.Errorf("lockNumber: %w", err)
+	}
+
+	queryWithdrawn := `
+	SELECT
+	    count(*)
+	FROM withdrawns
+	WHERE number=$1`
+
+	var count int
+	err = tx.GetContext(ctx, &count, queryWithdrawn, hold.Number)
+	if err != nil {
+		return Hold{}, Balance{}, fmt.Errorf("tx.GetContext: %w", err)
+	}
+
+	if count > 0 {
+		return Hold{}, Balance{}, oops.ErrWithdrawExists
+	}
+
+	if err = checkMerchant(ctx, tx, hold.MerchantID); err != nil {
+		return Hold{}, Balance{}, fmt.Errorf("checkMerchant: %w", err)
+	}
+
+	queryHold := `
+	INSERT INTO holds(id,user_id,number,sum,merchant_id,status,created_at,expires_at)
+	VALUES ($1,$2,$3,$4,$5,$6,NOW(),$7)
+	RETURNING id, user_id, number, sum, merchant_id, status, created_at, expires_at, closed_at`
+
+	err = tx.GetContext(ctx, &hold, queryHold,
+		hold.ID, hold.UserID, hold.Number, hold.Sum, hold.MerchantID, HoldStatusAuthorized, hold.ExpiresAt)
+	if err != nil {
+		return Hold{}, Balance{}, fmt.Errorf("tx.GetContext: %w", constraintError(err))
+	}
+
+	takes, err := consumeLots(ctx, tx, hold.UserID, hold.Sum)
+	if err != nil {
+		return Hold{}, Balance{}, fmt.Errorf("consumeLots: %w", err)
+	}
+
+	queryLots := `
+	INSERT INTO hold_lots(hold_id,lot_id,amount)
+	VALUES ($1,$2,$3)`
+
+	for _, v := range takes {
+		_, err = tx.ExecContext(ctx, queryLots, hold.ID, v.LotID, v.Amount)
+		if err != nil {
+			return Hold{}, Balance{}, fmt.Errorf("tx.ExecContext: %w", err)
+		}
+	}
+
+	queryBalance := `
+	UPDATE balances
+	SET
+	    current=current-$1,
+	    held=held+$1
+	WHERE user_id=$2
+	RETURNING user_id, current, pending, held, withdrawn, debt`
+
+	err = tx.GetContext(ctx, &balance, queryBalance, hold.Sum, hold.UserID)
+	if err != nil {
+		return Hold{}, Balance{}, fmt.Errorf("tx.GetContext: %w", constraintError(err))
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Hold{}, Balance{}, fmt.Errorf("tx.Commit: %w", err)
+	}
+
+	return hold, balance, nil
+}
+
+// CaptureHold turns an authorized hold of the user into a withdrawal.
+func (s Store) CaptureHold(ctx context.Context, userID, id uuid.UUID, notify Notify[Hold]) (Hold, Balance, error) {
+	tx, err := s.BeginTxx(ctx, nil)
+	if err != nil {
+		return Hold{}, Balance{}, fmt.Errorf("s.BeginTxx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err = lockBalance(ctx, tx, userID); err != nil {
+		return Hold{}, Balance{}, fmt.Errorf("lockBalance: %w", err)
+	}
+
+	hold, err := activeHold(ctx, tx, userID, id)
+	if err != nil {
+		return Hold{}, Balance{}, fmt.Errorf("activeHold: %w", err)
+	}
+
+	if !hold.ExpiresAt.After(time.Now()) {
+		return Hold{}, Balance{}, oops.ErrHoldNotActive
+	}
+
+	// The withdrawal is made at the merchant the hold was authorized for.
+	queryWithdraw := `
+	INSERT INTO withdrawns (user_id, number, sum, merchant_id, processed_at)
+	SELECT user_id, number, sum, merchant_id, NOW()
+	FROM holds
+	WHERE id=$1`
+
+	_, err = tx.ExecContext(ctx, queryWithdraw, hold.ID)
+	if err != nil {
+		return Hold{}, Balance{}, fmt.Errorf("tx.ExecContext: %w", constraintError(err))
+	}
+
+	queryBalance := `
+	UPDATE balances
+	SET
+	    held=GREATEST(held-$1, 0),
+	    withdrawn=withdrawn+$1
+	WHERE user_id=$2
+	RETURNING user_id, current, pending, held, withdrawn, debt`
+
+	var balance Balance
+	err = tx.GetContext(ctx, &balance, queryBalance, hold.Sum, hold.UserID)
+	if err != nil {
+		return Hold{}, Balance{}, fmt.Errorf("tx.GetContext: %w", err)
+	}
+
+	hold, err = closeHold(ctx, tx, hold.ID, HoldStatusCaptured)
+	if err != nil {
+		return Hold{}, Balance{}, fmt.Errorf("closeHold: %w", err)
+	}
+
+	if err = enqueueWebhooks(ctx, tx, notify, hold); err != nil {
+		return Hold{}, Balance{}, fmt.Errorf("enqueueWebhooks: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Hold{}, Balance{}, fmt.Errorf("tx.Commit: %w", err)
+	}
+
+	return hold, balance, nil
+}
+
+// VoidHold releases an authorized hold of the user back to the lots it was
+// taken from, status tells a void by the user from an expiry.
+func (s Store) VoidHold(ctx context.Context, userID, id uuid.UUID, status string) (Hold, Balance, error) {
+	tx, err := s.BeginTxx(ctx, nil)
+	if err != nil {
+		return Hold{}, Balance{}, fmt.Errorf("s.BeginTxx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err = lockBalance(ctx, tx, userID); err != nil {
+		return Hold{}, Balance{}, fmt.Errorf("lockBalance: %w", err)
+	}
+
+	hold, err := activeHold(ctx, tx, userID, id)
+	if err != nil {
+		return Hold{}, Balance{}, fmt.Errorf("activeHold: %w", err)
+	}
+
+	queryLots := `
+	UPDATE point_lots l
+	SET remaining=l.remaining+h.amount
+	FROM hold_lots h
+	WHERE h.hold_id=$1 AND l.id=h.lot_id`
+
+	_, err = tx.ExecContext(ctx, queryLots, hold.ID)
+	if err != nil {
+		return Hold{}, Balance{}, fmt.Errorf("tx.ExecContext: %w", err)
+	}
+
+	queryBalance := `
+	UPDATE balances
+	SET
+	    current=current+$1,
+	    held=GREATEST(held-$1, 0)
+	WHERE user_id=$2`
+
+	_, err = tx.ExecContext(ctx, queryBalance, hold.Sum, hold.UserID)
+	if err != nil {
+		return Hold{}, Balance{}, fmt.Errorf("tx.ExecContext: %w", err)
+	}
+
+	balance, err := settleDebt(ctx, tx, hold.UserID)
+	if err != nil {
+		return Hold{}, Balance{}, fmt.Errorf("settleDebt: %w", err)
+	}
+
+	hold, err = closeHold(ctx, tx, hold.ID, status)
+	if err != nil {
+		return Hold{}, Balance{}, fmt.Errorf("closeHold: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Hold{}, Balance{}, fmt.Errorf("tx.Commit: %w", err)
+	}
+
+	return hold, balance, nil
+}
+
+func (s Store) ExpiredHolds(ctx context.Context) ([]Hold, error) {
+	query := `
+	SELECT
+	    id,
+	    user_id,
+	    number,
+	    sum,
+	    status,
+	    created_at,
+	    expires_at,
+	    closed_at
+	FROM holds
+	WHERE status=$1 AND expires_at<=NOW()`
+
+	var holds []Hold
+	err := s.SelectContext(ctx, &holds, query, HoldStatusAuthorized)
+	if err != nil {
+		return nil, fmt.Errorf("s.SelectContext: %w", err)
+	}
+
+	return holds, nil
+}
+
+// activeHold must run with the balance of the user locked.
+func activeHold(ctx context.Context, tx *sqlx.Tx, userID, id uuid.UUID) (Hold, error) {
+	query := `
+	SELECT
+	    id,
+	    user_id,
+	    number,
+	    sum,
+	    status,
+	    created_at,
+	    expires_at,
+	    closed_at
+	FROM holds
+	WHERE id=$1 AND user_id=$2`
+
+	var hold Hold
+	err := tx.GetContext(ctx, &hold, query, id, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Hold{}, oops.ErrHoldNotFound
+		}
+		return Hold{}, fmt.Errorf("tx.GetContext: %w", err)
+	}
+
+	if hold.Status != HoldStatusAuthorized {
+		return Hold{}, oops.ErrHoldNotActive
+	}
+
+	return hold, nil
+}
+
+func closeHold(ctx context.Context, tx *sqlx.Tx, id uuid.UUID, status string) (Hold, error) {
+	query := `
+	UPDATE holds
+	SET status=$1,closed_at=NOW()
+	WHERE id=$2
+	RETURNING id, user_id, number, sum, status, created_at, expires_at, closed_at`
+
+	var hold Hold
+	err := tx.GetContext(ctx, &hold, query, status, id)
+	if err != nil {
+		return Hold{}, fmt.Errorf("tx.GetContext: %w", err)
+	}
+
+	return hold, nil
+}
+
+// lockNumber serializes withdrawals and holds of one order number until the
+// transaction ends, they belong to different users and balance locks do not
+// order them.
+func lockNumber(ctx context.Context, tx *sqlx.Tx, number string) error {
+	_, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, number)
+	if err != nil {
+		return fmt.Errorf("tx.ExecContext: %w", err)
+	}
+
+	return nil
+}
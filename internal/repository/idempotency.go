@@ -0,0 +1,127 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type IdempotencyKey struct {
+	UserID       uuid.UUID `db:"user_id"`
+	Key          string    `db:"key"`
+	RequestHash  string    `db:"request_hash"`
+	StatusCode   *int      `db:"status_code"`
+	ContentType  *string   `db:"content_type"`
+	ResponseBody []byte    `db:"response_body"`
+	CreatedAt    time.Time `db:"created_at"`
+}
+
+// ReserveIdempotencyKey inserts the key unless a live one already exists and
+// reports whether the caller now owns it. Keys older than ttl are reused, and
+// so are keys still in progress after lease: their request never finished.
+func (s Store) ReserveIdempotencyKey(
+	ctx context.Context,
+	key IdempotencyKey,
+	ttl, lease time.Duration,
+) (bool, error) {
+	query := `
+	INSERT INTO idempotency_keys(user_id,key,request_hash,created_at)
+	VALUES ($1,$2,$3,NOW())
+	ON CONFLICT (user_id,key) DO UPDATE
+	SET request_hash=EXCLUDED.request_hash,status_code=NULL,content_type=NULL,response_body=NULL,created_at=NOW()
+	WHERE idempotency_keys.created_at < NOW()-make_interval(secs => $4)
+	   OR (idempotency_keys.status_code IS NULL AND idempotency_keys.created_at < NOW()-make_interval(secs => $5))`
+
+	res, err := s.ExecContext(ctx, query, key.UserID, key.Key, key.RequestHash, ttl.Seconds(), lease.Seconds())
+	if err != nil {
+		return false, fmt.Errorf("s.ExecContext: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("res.RowsAffected(): %w", err)
+	}
+
+	return n == 1, nil
+}
+
+func (s Store) IdempotencyKey(ctx context.Context, id uuid.UUID, key string) (IdempotencyKey, error) {
+	query := `
+	SELECT
+	    user_id,
+	    key,
+	    request_hash,
+	    status_code,
+	    content_type,
+	    response_body,
+	    created_at
+	FROM idempotency_keys
+	WHERE user_id=$1 AND key=$2`
+
+	var result IdempotencyKey
+	err := s.GetContext(ctx, &result, query, id, key)
+	if err != nil {
+		return IdempotencyKey{}, fmt.Errorf("s.GetContext: %w", err)
+	}
+
+	return result, nil
+}
+
+func (s Store) SaveIdempotencyKey(ctx context.Context, key IdempotencyKey) error {
+	query := `
+	UPDATE idempotency_keys
+	SET status_code=$1,content_type=$2,response_body=$3
+	WHERE user_id=$4 AND key=$5`
+
+	res, err := s.ExecContext(ctx, query, key.StatusCode, key.ContentType, key.ResponseBody, key.UserID, key.Key)
+	if err != nil {
+		return fmt.Errorf("s.ExecContext: %w", err)
+	}
+
+	_, err = res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("res.RowsAffected(): %w", err)
+	}
+
+	return nil
+}
+
+func (s Store) DeleteIdempotencyKey(ctx context.Context, id uuid.UUID, key string) error {
+	query := `
+	DELETE FROM idempotency_keys
+	WHERE user_id=$1 AND key=$2`
+
+	res, err := s.ExecContext(ctx, query, id, key)
+	if err != nil {
+		return fmt.Errorf("s.ExecContext: %w", err)
+	}
+
+	_, err = res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("res.RowsAffected(): %w", err)
+	}
+
+	return nil
+}
+
+// PurgeIdempotencyKeys deletes the keys older than ttl and returns how many
+// were deleted.
+func (s Store) PurgeIdempotencyKeys(ctx context.Context, ttl time.Duration) (int64, error) {
+	query := `
+	DELETE FROM idempotency_keys
+	WHERE created_at < NOW()-make_interval(secs => $1)`
+
+	res, err := s.ExecContext(ctx, query, ttl.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("s.ExecContext: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("res.RowsAffected(): %w", err)
+	}
+
+	return n, nil
+}
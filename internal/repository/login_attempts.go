@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	AttemptScopeLogin = "login"
+	AttemptScopeIP    = "ip"
+	// AttemptScopeReset counts password reset requests per login, they must
+	// not lock the login itself.
+	AttemptScopeReset = "reset"
+)
+
+type LoginAttempt struct {
+	Scope string `db:"scope"`
+	Key   string `db:"key"`
+}
+
+// LockedUntil returns the latest active lock among attempts, zero time if none.
+func (s Store) LockedUntil(ctx context.Context, attempts []LoginAttempt) (time.Time, error) {
+	query := `
+	SELECT
+	    locked_until
+	FROM login_attempts
+	WHERE scope=$1 AND key=$2 AND locked_until > NOW()`
+
+	var result time.Time
+	for _, v := range attempts {
+		var locked []time.Time
+		err := s.SelectContext(ctx, &locked, query, v.Scope, v.Key)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("s.SelectContext: %w", err)
+		}
+
+		if locked != nil && locked[0].After(result) {
+			result = locked[0]
+		}
+	}
+
+	return result, nil
+}
+
+// AddLoginFailure counts a failed attempt and returns the number of failures
+// within window, older failures are forgotten.
+func (s Store) AddLoginFailure(ctx context.Context, attempt LoginAttempt, window time.Duration) (int, error) {
+	query := `
+	INSERT INTO login_attempts(scope,key,failures,updated_at)
+	VALUES ($1,$2,1,NOW())
+	ON CONFLICT (scope,key) DO UPDATE
+	SET failures=CASE
+	        WHEN login_attempts.updated_at < NOW()-make_interval(secs => $3) THEN 1
+	        ELSE login_attempts.failures+1
+	    END,
+	    updated_at=NOW()
+	RETURNING failures`
+
+	var failures int
+	err := s.GetContext(ctx, &failures, query, attempt.Scope, attempt.Key, window.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("s.GetContext: %w", err)
+	}
+
+	return failures, nil
+}
+
+func (s Store) LockLogin(ctx context.Context, attempt LoginAttempt, lock time.Duration) error {
+	query := `
+	UPDATE login_attempts
+	SET locked_until=NOW()+make_interval(secs => $1)
+	WHERE scope=$2 AND key=$3`
+
+	res, err := s.ExecContext(ctx, query, lock.Seconds(), attempt.Scope, attempt.Key)
+	if err != nil {
+		return fmt.Errorf("s.ExecContext: %w", err)
+	}
+
+	_, err = res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("res.RowsAffected(): %w", err)
+	}
+
+	return nil
+}
+
+func (s Store) ResetLoginFailures(ctx context.Context, attempt LoginAttempt) error {
+	query := `
+	DELETE FROM login_attempts
+	WHERE scope=$1 AND key=$2`
+
+	res, err := s.ExecContext(ctx, query, attempt.Scope, attempt.Key)
+	if err != nil {
+		return fmt.Errorf("s.ExecContext: %w", err)
+	}
+
+	_, err = res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("res.RowsAffected(): %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,354 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	LotSourceAccrual    = "accrual"
+	LotSourceAdjustment = "adjustment"
+	LotSourceRefund     = "refund"
+)
+
+// PointLot is a portion of the balance earned at once. The remaining amounts
+// of pending lots add up to balances.pending, of the others to balances.current.
+type PointLot struct {
+	ID          int64      `db:"id"`
+	UserID      uuid.UUID  `db:"user_id"`
+	Source      string     `db:"source"`
+	Number      *string    `db:"number"`
+	Amount      float32    `db:"amount"`
+	Remaining   float32    `db:"remaining"`
+	Pending     bool       `db:"pending"`
+	EarnedAt    time.Time  `db:"earned_at"`
+	AvailableAt time.Time  `db:"available_at"`
+	ExpiresAt   *time.Time `db:"expires_at"`
+}
+
+// CreditTerms tell when credited points can be spent and when they expire,
+// nil means immediately and never.
+type CreditTerms struct {
+	AvailableAt *time.Time
+	ExpiresAt   *time.Time
+}
+
+type Expiring struct {
+	Sum    float32    `db:"sum"`
+	NextAt *time.Time `db:"next_at"`
+}
+
+// addLot must run in the transaction that credits balances.current, or
+// balances.pending for a pending lot.
+func addLot(ctx context.Context, tx *sqlx.Tx, lot PointLot) error {
+	query := `
+	INSERT INTO point_lots(user_id,source,number,amount,remaining,pending,earned_at,available_at,expires_at)
+	VALUES ($1,$2,$3,$4,$4,$5,NOW(),COALESCE($6,NOW()),$7)`
+
+	var availableAt *time.Time
+	if lot.Pending {
+		availableAt = &lot.AvailableAt
+	}
+
+	_, err := tx.ExecContext(ctx, query,
+		lot.UserID, lot.Source, lot.Number, lot.Amount, lot.Pending, availableAt, lot.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("tx.ExecContext: %w", err)
+	}
+
+	return nil
+}
+
+// LotTake is the amount taken from one lot by a debit, ExpiresAt is the
+// expiry of that lot.
+type LotTake struct {
+	LotID     int64      `db:"lot_id"`
+	Amount    float32    `db:"amount"`
+	ExpiresAt *time.Time `db:"expires_at"`
+}
+
+// consumeLots takes amount from the oldest lots first and reports what was
+// taken from each. It must run in the transaction that debits
+// balances.current, the locked balance row keeps concurrent debits of the
+// same user apart.
+func consumeLots(ctx context.Context, tx *sqlx.Tx, id uuid.UUID, amount float32) ([]LotTake, error) {
+	query := `
+	WITH ordered AS (
+		SELECT
+		    id,
+		    remaining,
+		    sum(remaining) OVER (ORDER BY earned_at, id) - remaining AS before
+		FROM point_lots
+		WHERE user_id=$1 AND remaining > 0 AND NOT pending
+	)
+	UPDATE point_lots l
+	SET remaining=l.remaining-LEAST(o.remaining, $2-o.before)
+	FROM ordered o
+	WHERE l.id=o.id AND o.before < $2
+	RETURNING l.id AS lot_id, LEAST(o.remaining, $2-o.before) AS amount, l.expires_at`
+
+	var takes []LotTake
+	err := tx.SelectContext(ctx, &takes, query, id, amount)
+	if err != nil {
+		return nil, fmt.Errorf("tx.SelectContext: %w", err)
+	}
+
+	return takes, nil
+}
+
+// lockBalance locks the balance row of the user until the transaction ends.
+func lockBalance(ctx context.Context, tx *sqlx.Tx, id uuid.UUID) (Balance, error) {
+	query := `
+	SELECT
+	    user_id,
+	    current,
+	    pending,
+	    held,
+	    withdrawn,
+	    debt
+	FROM balances
+	WHERE user_id=$1
+	FOR UPDATE`
+
+	var balance Balance
+	err := tx.GetContext(ctx, &balance, query, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Balance{}, oops.ErrAccountNotFound
+		}
+		return Balance{}, fmt.Errorf("tx.GetContext: %w", err)
+	}
+
+	return balance, nil
+}
+
+// settleDebt pays the debt of the user off the current balance. It must run
+// after a credit, in the transaction holding the balance lock, and returns the
+// balance as it is after the payment.
+func settleDebt(ctx context.Context, tx *sqlx.Tx, id uuid.UUID) (Balance, error) {
+	query := `
+	SELECT
+	    user_id,
+	    current,
+	    pending,
+	    held,
+	    withdrawn,
+	    debt
+	FROM balances
+	WHERE user_id=$1`
+
+	var balance Balance
+	err := tx.GetContext(ctx, &balance, query, id)
+	if err != nil {
+		return Balance{}, fmt.Errorf("tx.GetContext: %w", err)
+	}
+
+	amount := balance.Debt
+	if balance.Current < amount {
+		amount = balance.Current
+	}
+	if amount <= 0 {
+		return balance, nil
+	}
+
+	if _, err = consumeLots(ctx, tx, id, amount); err != nil {
+		return Balance{}, fmt.Errorf("consumeLots: %w", err)
+	}
+
+	queryPay := `
+	UPDATE balances
+	SET
+	    current=GREATEST(current-$1, 0),
+	    debt=GREATEST(debt-$1, 0)
+	WHERE user_id=$2
+	RETURNING user_id, current, pending, held, withdrawn, debt`
+
+	err = tx.GetContext(ctx, &balance, queryPay, amount, id)
+	if err != nil {
+		return Balance{}, fmt.Errorf("tx.GetContext: %w", err)
+	}
+
+	return balance, nil
+}
+
+// ExpiringPoints sums what is left of the lots expiring before the given time.
+func (s Store) ExpiringPoints(ctx context.Context, id uuid.UUID, before time.Time) (Expiring, error) {
+	query := `
+	SELECT
+	    COALESCE(sum(remaining), 0) AS sum,
+	    min(expires_at) AS next_at
+	FROM point_lots
+	WHERE user_id=$1 AND remaining > 0 AND NOT pending AND expires_at<=$2`
+
+	var expiring Expiring
+	err := s.GetContext(ctx, &expiring, query, id, before)
+	if err != nil {
+		return Expiring{}, fmt.Errorf("s.GetContext: %w", err)
+	}
+
+	return expiring, nil
+}
+
+func (s Store) UsersWithExpiredPoints(ctx context.Context) ([]uuid.UUID, error) {
+	query := `
+	SELECT DISTINCT
+	    user_id
+	FROM point_lots
+	WHERE remaining > 0 AND NOT pending AND expires_at<=NOW()`
+
+	var ids []uuid.UUID
+	err := s.SelectContext(ctx, &ids, query)
+	if err != nil {
+		return nil, fmt.Errorf("s.SelectContext: %w", err)
+	}
+
+	return ids, nil
+}
+
+// ExpirePoints writes off the expired lots of the user, records an expiry entry
+// for each of them and returns the new balance with the amount written off.
+// A balance holding less than the expired lots fails with oops.ErrBalanceDrift.
+func (s Store) ExpirePoints(ctx context.Context, id uuid.UUID) (Balance, float32, error) {
+	tx, err := s.BeginTxx(ctx, nil)
+	if err != nil {
+		return Balance{}, 0, fmt.Errorf("s.BeginTxx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	balance, err := lockBalance(ctx, tx, id)
+	if err != nil {
+		return Balance{}, 0, fmt.Errorf("lockBalance: %w", err)
+	}
+
+	queryExpire := `
+	WITH expired AS (
+		SELECT
+		    id,
+		    remaining
+		FROM point_lots
+		WHERE user_id=$1 AND remaining > 0 AND NOT pending AND expires_at<=NOW()
+	), updated AS (
+		UPDATE point_lots l
+		SET remaining=0
+		FROM expired e
+		WHERE l.id=e.id
+	)
+	INSERT INTO point_expirations(user_id,lot_id,amount,expired_at)
+	SELECT $1, id, remaining, NOW()
+	FROM expired
+	RETURNING amount`
+
+	var amounts []float32
+	err = tx.SelectContext(ctx, &amounts, queryExpire, id)
+	if err != nil {
+		return Balance{}, 0, fmt.Errorf("tx.SelectContext: %w", err)
+	}
+
+	var sum float32
+	for _, v := range amounts {
+		sum += v
+	}
+
+	if cents(sum) > cents(balance.Current) {
+		return Balance{}, 0, fmt.Errorf("%w: expired lots hold %.2f, the balance %.2f",
+			oops.ErrBalanceDrift, sum, balance.Current)
+	}
+
+	queryBalance := `
+	UPDATE balances
+	SET current=current-$1
+	WHERE user_id=$2
+	RETURNING user_id, current, pending, held, withdrawn, debt`
+
+	err = tx.GetContext(ctx, &balance, queryBalance, sum, id)
+	if err != nil {
+		return Balance{}, 0, fmt.Errorf("tx.GetContext: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Balance{}, 0, fmt.Errorf("tx.Commit: %w", err)
+	}
+
+	return balance, sum, nil
+}
+
+func (s Store) UsersWithMaturedPoints(ctx context.Context) ([]uuid.UUID, error) {
+	query := `
+	SELECT DISTINCT
+	    user_id
+	FROM point_lots
+	WHERE pending AND available_at<=NOW()`
+
+	var ids []uuid.UUID
+	err := s.SelectContext(ctx, &ids, query)
+	if err != nil {
+		return nil, fmt.Errorf("s.SelectContext: %w", err)
+	}
+
+	return ids, nil
+}
+
+// ReleasePoints moves the lots of the user whose hold is over from pending to
+// current and returns the new balance with the amount released.
+func (s Store) ReleasePoints(ctx context.Context, id uuid.UUID) (Balance, float32, error) {
+	tx, err := s.BeginTxx(ctx, nil)
+	if err != nil {
+		return Balance{}, 0, fmt.Errorf("s.BeginTxx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err = lockBalance(ctx, tx, id); err != nil {
+		return Balance{}, 0, fmt.Errorf("lockBalance: %w", err)
+	}
+
+	queryRelease := `
+	UPDATE point_lots
+	SET pending=false
+	WHERE user_id=$1 AND pending AND available_at<=NOW()
+	RETURNING remaining`
+
+	var amounts []float32
+	err = tx.SelectContext(ctx, &amounts, queryRelease, id)
+	if err != nil {
+		return Balance{}, 0, fmt.Errorf("tx.SelectContext: %w", err)
+	}
+
+	var sum float32
+	for _, v := range amounts {
+		sum += v
+	}
+
+	queryBalance := `
+	UPDATE balances
+	SET
+	    current=current+$1,
+	    pending=GREATEST(pending-$1, 0)
+	WHERE user_id=$2`
+
+	_, err = tx.ExecContext(ctx, queryBalance, sum, id)
+	if err != nil {
+		return Balance{}, 0, fmt.Errorf("tx.ExecContext: %w", err)
+	}
+
+	balance, err := settleDebt(ctx, tx, id)
+	if err != nil {
+		return Balance{}, 0, fmt.Errorf("settleDebt: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Balance{}, 0, fmt.Errorf("tx.Commit: %w", err)
+	}
+
+	return balance, sum, nil
+}
@@ -0,0 +1,11 @@
+CREATE TABLE order_events (
+id bigserial primary key ,
+user_id uuid,
+number text,
+previous_status text,
+status text,
+accrual float,
+payload jsonb,
+created_at timestamptz default now()
+);
+CREATE INDEX order_events_number_idx ON order_events (number);
@@ -0,0 +1,23 @@
+CREATE TABLE webhooks (
+id uuid primary key ,
+url text not null ,
+secret text not null ,
+event_types text[] not null ,
+active bool default true ,
+created_at timestamptz default now()
+);
+
+CREATE TABLE webhook_deliveries (
+id bigserial primary key ,
+webhook_id uuid references webhooks(id) on delete cascade ,
+event_type text ,
+payload jsonb ,
+status text default 'pending',
+attempts int default 0 ,
+response_code int ,
+last_error text ,
+next_attempt_at timestamptz default now() ,
+created_at timestamptz default now() ,
+delivered_at timestamptz
+);
+CREATE INDEX webhook_deliveries_pending_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
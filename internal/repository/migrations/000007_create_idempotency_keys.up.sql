@@ -0,0 +1,9 @@
+CREATE TABLE idempotency_keys (
+user_id uuid ,
+key text ,
+request_hash text not null ,
+status_code int ,
+response_body bytea ,
+created_at timestamptz default now() ,
+primary key (user_id, key)
+);
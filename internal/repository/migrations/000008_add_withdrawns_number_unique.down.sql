@@ -0,0 +1 @@
+DROP INDEX IF EXISTS withdrawns_number_key;
@@ -0,0 +1,15 @@
+DO $$
+DECLARE
+    duplicates text;
+BEGIN
+    SELECT string_agg(number, ', ' ORDER BY number) INTO duplicates
+    FROM (SELECT number FROM withdrawns GROUP BY number HAVING count(*) > 1) d;
+
+    IF duplicates IS NOT NULL THEN
+        RAISE EXCEPTION 'duplicate withdrawals for orders %, resolve them before adding withdrawns_number_key',
+            duplicates;
+    END IF;
+END $$;
+
+DROP INDEX IF EXISTS withdrawns_number_key;
+CREATE UNIQUE INDEX withdrawns_number_key ON withdrawns (number);
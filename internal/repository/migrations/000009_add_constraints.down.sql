@@ -0,0 +1,37 @@
+ALTER TABLE order_events DROP CONSTRAINT IF EXISTS order_events_user_id_fkey;
+
+DROP INDEX IF EXISTS withdrawns_user_id_idx;
+ALTER TABLE withdrawns
+    DROP CONSTRAINT IF EXISTS withdrawns_sum_check,
+    ALTER COLUMN processed_at DROP DEFAULT,
+    ALTER COLUMN processed_at DROP NOT NULL,
+    ALTER COLUMN sum DROP NOT NULL,
+    ALTER COLUMN number DROP NOT NULL,
+    ALTER COLUMN user_id DROP NOT NULL,
+    DROP CONSTRAINT IF EXISTS withdrawns_user_id_fkey,
+    DROP COLUMN IF EXISTS id;
+
+ALTER TABLE balances
+    DROP CONSTRAINT IF EXISTS balances_withdrawn_check,
+    DROP CONSTRAINT IF EXISTS balances_current_check,
+    ALTER COLUMN withdrawn DROP NOT NULL,
+    ALTER COLUMN current DROP NOT NULL,
+    DROP CONSTRAINT IF EXISTS balances_user_id_fkey;
+
+DROP INDEX IF EXISTS orders_checked_idx;
+DROP INDEX IF EXISTS orders_user_id_idx;
+ALTER TABLE orders
+    ALTER COLUMN checked DROP DEFAULT,
+    ALTER COLUMN checked DROP NOT NULL,
+    ALTER COLUMN uploaded_at DROP NOT NULL,
+    ALTER COLUMN status DROP NOT NULL,
+    ALTER COLUMN user_id DROP NOT NULL,
+    DROP CONSTRAINT IF EXISTS orders_user_id_fkey,
+    ADD CONSTRAINT orders_number_key UNIQUE (number),
+    DROP CONSTRAINT IF EXISTS orders_pkey;
+
+DROP INDEX IF EXISTS users_token_idx;
+ALTER TABLE users
+    ALTER COLUMN token DROP NOT NULL,
+    ALTER COLUMN password DROP NOT NULL,
+    ALTER COLUMN login DROP NOT NULL;
@@ -0,0 +1,101 @@
+-- Rows pointing to missing users and ledger rows the constraints below reject
+-- are ledger data, the migration stops and lists them for an operator to
+-- resolve instead of dropping them.
+DO $$
+DECLARE
+    problems text[] := '{}';
+    found text;
+BEGIN
+    SELECT string_agg(coalesce(number, '<null>'), ', ' ORDER BY number) INTO found
+    FROM orders
+    WHERE number IS NULL OR user_id IS NULL OR user_id NOT IN (SELECT id FROM users);
+    IF found IS NOT NULL THEN
+        problems := problems || ('orders without a number or user: ' || found);
+    END IF;
+
+    SELECT string_agg(user_id::text, ', ' ORDER BY user_id) INTO found
+    FROM balances
+    WHERE user_id NOT IN (SELECT id FROM users);
+    IF found IS NOT NULL THEN
+        problems := problems || ('balances of missing users: ' || found);
+    END IF;
+
+    SELECT string_agg(user_id::text, ', ' ORDER BY user_id) INTO found
+    FROM balances
+    WHERE current < 0 OR withdrawn < 0;
+    IF found IS NOT NULL THEN
+        problems := problems || ('negative balances of users: ' || found);
+    END IF;
+
+    SELECT string_agg(coalesce(number, '<null>'), ', ' ORDER BY number) INTO found
+    FROM withdrawns
+    WHERE user_id IS NULL OR user_id NOT IN (SELECT id FROM users)
+       OR number IS NULL OR sum IS NULL OR sum <= 0;
+    IF found IS NOT NULL THEN
+        problems := problems || ('withdrawals without a user, number or positive sum: ' || found);
+    END IF;
+
+    SELECT string_agg(id::text, ', ' ORDER BY id) INTO found
+    FROM order_events
+    WHERE user_id IS NULL OR user_id NOT IN (SELECT id FROM users);
+    IF found IS NOT NULL THEN
+        problems := problems || ('order events without a user: ' || found);
+    END IF;
+
+    IF cardinality(problems) > 0 THEN
+        RAISE EXCEPTION 'resolve these rows before adding the constraints: %',
+            array_to_string(problems, '; ');
+    END IF;
+END $$;
+
+-- Missing values with an obvious default are backfilled.
+INSERT INTO balances(user_id)
+SELECT id FROM users
+WHERE id NOT IN (SELECT user_id FROM balances);
+
+UPDATE orders SET status='NEW' WHERE status IS NULL;
+UPDATE orders SET uploaded_at=NOW() WHERE uploaded_at IS NULL;
+UPDATE orders SET checked=false WHERE checked IS NULL;
+UPDATE balances SET current=0 WHERE current IS NULL;
+UPDATE balances SET withdrawn=0 WHERE withdrawn IS NULL;
+UPDATE withdrawns SET processed_at=NOW() WHERE processed_at IS NULL;
+
+ALTER TABLE users
+    ALTER COLUMN login SET NOT NULL,
+    ALTER COLUMN password SET NOT NULL,
+    ALTER COLUMN token SET NOT NULL;
+CREATE INDEX users_token_idx ON users (token);
+
+ALTER TABLE orders
+    DROP CONSTRAINT orders_number_key,
+    ADD CONSTRAINT orders_pkey PRIMARY KEY (number),
+    ADD CONSTRAINT orders_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id),
+    ALTER COLUMN user_id SET NOT NULL,
+    ALTER COLUMN status SET NOT NULL,
+    ALTER COLUMN uploaded_at SET NOT NULL,
+    ALTER COLUMN checked SET NOT NULL,
+    ALTER COLUMN checked SET DEFAULT false;
+CREATE INDEX orders_user_id_idx ON orders (user_id);
+CREATE INDEX orders_checked_idx ON orders (checked, uploaded_at);
+
+ALTER TABLE balances
+    ADD CONSTRAINT balances_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id),
+    ALTER COLUMN current SET NOT NULL,
+    ALTER COLUMN withdrawn SET NOT NULL,
+    ADD CONSTRAINT balances_current_check CHECK (current >= 0),
+    ADD CONSTRAINT balances_withdrawn_check CHECK (withdrawn >= 0);
+
+ALTER TABLE withdrawns
+    ADD COLUMN id bigserial,
+    ADD CONSTRAINT withdrawns_pkey PRIMARY KEY (id),
+    ADD CONSTRAINT withdrawns_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id),
+    ALTER COLUMN user_id SET NOT NULL,
+    ALTER COLUMN number SET NOT NULL,
+    ALTER COLUMN sum SET NOT NULL,
+    ALTER COLUMN processed_at SET NOT NULL,
+    ALTER COLUMN processed_at SET DEFAULT now(),
+    ADD CONSTRAINT withdrawns_sum_check CHECK (sum > 0);
+CREATE INDEX withdrawns_user_id_idx ON withdrawns (user_id);
+
+ALTER TABLE order_events
+    ADD CONSTRAINT order_events_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id);
@@ -0,0 +1,21 @@
+ALTER TABLE users ADD COLUMN blocked bool not null default false;
+
+CREATE TABLE balance_adjustments (
+id bigserial primary key ,
+user_id uuid not null references users(id) ,
+amount float not null ,
+reason text not null ,
+operator text not null ,
+created_at timestamptz not null default now()
+);
+CREATE INDEX balance_adjustments_user_id_idx ON balance_adjustments (user_id);
+
+CREATE TABLE audit_log (
+id bigserial primary key ,
+operator text not null ,
+action text not null ,
+user_id uuid ,
+details jsonb ,
+created_at timestamptz not null default now()
+);
+CREATE INDEX audit_log_user_id_idx ON audit_log (user_id);
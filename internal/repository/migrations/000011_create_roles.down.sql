@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS api_keys;
+ALTER TABLE users
+    DROP CONSTRAINT IF EXISTS users_role_check,
+    DROP COLUMN IF EXISTS permissions,
+    DROP COLUMN IF EXISTS role;
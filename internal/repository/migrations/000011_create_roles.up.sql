@@ -0,0 +1,14 @@
+ALTER TABLE users
+    ADD COLUMN role text not null default 'customer',
+    ADD COLUMN permissions text[] not null default '{}',
+    ADD CONSTRAINT users_role_check CHECK (role IN ('customer', 'support', 'admin', 'merchant'));
+
+CREATE TABLE api_keys (
+id uuid primary key ,
+name text not null ,
+key_hash text not null unique ,
+permissions text[] not null default '{}' ,
+created_by text not null ,
+created_at timestamptz not null default now() ,
+revoked_at timestamptz
+);
@@ -0,0 +1,8 @@
+CREATE TABLE login_attempts (
+scope text not null ,
+key text not null ,
+failures int not null default 0 ,
+locked_until timestamptz ,
+updated_at timestamptz not null default now() ,
+primary key (scope, key)
+);
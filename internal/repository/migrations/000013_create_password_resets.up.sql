@@ -0,0 +1,8 @@
+CREATE TABLE password_resets (
+token_hash text primary key ,
+user_id uuid not null references users(id) ,
+expires_at timestamptz not null ,
+used_at timestamptz ,
+created_at timestamptz not null default now()
+);
+CREATE INDEX password_resets_user_id_idx ON password_resets (user_id);
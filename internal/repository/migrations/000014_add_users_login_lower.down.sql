@@ -0,0 +1 @@
+DROP INDEX IF EXISTS users_login_lower_key;
@@ -0,0 +1,16 @@
+DO $$
+DECLARE
+    duplicates text;
+BEGIN
+    SELECT string_agg(login, ', ' ORDER BY login) INTO duplicates
+    FROM (SELECT lower(login) AS login FROM users GROUP BY lower(login) HAVING count(*) > 1) d;
+
+    IF duplicates IS NOT NULL THEN
+        RAISE EXCEPTION 'logins differing only in case: %, rename all but one of each before adding users_login_lower_key',
+            duplicates;
+    END IF;
+END $$;
+
+DROP INDEX IF EXISTS users_login_lower_key;
+-- Logins are compared case-insensitively, new ones are stored lowercased.
+CREATE UNIQUE INDEX users_login_lower_key ON users (lower(login));
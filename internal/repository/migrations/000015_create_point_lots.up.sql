@@ -0,0 +1,28 @@
+CREATE TABLE point_lots (
+id bigserial primary key ,
+user_id uuid not null references users(id) ,
+source text not null ,
+number text ,
+amount float not null ,
+remaining float not null ,
+earned_at timestamptz not null default now() ,
+expires_at timestamptz ,
+CONSTRAINT point_lots_remaining_check CHECK (remaining >= 0 AND remaining <= amount)
+);
+CREATE INDEX point_lots_user_id_idx ON point_lots (user_id, earned_at) WHERE remaining > 0;
+CREATE INDEX point_lots_expires_at_idx ON point_lots (expires_at) WHERE remaining > 0;
+
+CREATE TABLE point_expirations (
+id bigserial primary key ,
+user_id uuid not null references users(id) ,
+lot_id bigint not null references point_lots(id) ,
+amount float not null ,
+expired_at timestamptz not null default now()
+);
+CREATE INDEX point_expirations_user_id_idx ON point_expirations (user_id);
+
+-- Points earned before lots existed carry over as one lot that never expires.
+INSERT INTO point_lots(user_id,source,amount,remaining,earned_at)
+SELECT user_id, 'opening', current, current, NOW()
+FROM balances
+WHERE current > 0;
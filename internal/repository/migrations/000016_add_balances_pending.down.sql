@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS point_lots_available_at_idx;
+ALTER TABLE point_lots
+    DROP COLUMN IF EXISTS available_at,
+    DROP COLUMN IF EXISTS pending;
+
+UPDATE balances SET current=current+pending;
+ALTER TABLE balances
+    DROP CONSTRAINT IF EXISTS balances_pending_check,
+    DROP COLUMN IF EXISTS pending;
@@ -0,0 +1,8 @@
+ALTER TABLE balances
+    ADD COLUMN pending float not null default 0,
+    ADD CONSTRAINT balances_pending_check CHECK (pending >= 0);
+
+ALTER TABLE point_lots
+    ADD COLUMN pending bool not null default false,
+    ADD COLUMN available_at timestamptz not null default now();
+CREATE INDEX point_lots_available_at_idx ON point_lots (available_at) WHERE pending;
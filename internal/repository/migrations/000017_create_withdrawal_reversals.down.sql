@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS withdrawal_reversals;
+ALTER TABLE withdrawns
+    DROP CONSTRAINT IF EXISTS withdrawns_reversed_check,
+    DROP COLUMN IF EXISTS reversed,
+    DROP COLUMN IF EXISTS status;
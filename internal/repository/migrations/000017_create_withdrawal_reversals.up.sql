@@ -0,0 +1,15 @@
+ALTER TABLE withdrawns
+    ADD COLUMN status text not null default 'completed',
+    ADD COLUMN reversed float not null default 0,
+    ADD CONSTRAINT withdrawns_reversed_check CHECK (reversed >= 0 AND reversed <= sum);
+
+CREATE TABLE withdrawal_reversals (
+id bigserial primary key ,
+withdrawal_id bigint not null references withdrawns(id) ,
+user_id uuid not null references users(id) ,
+amount float not null check (amount > 0) ,
+reason text not null ,
+operator text not null ,
+created_at timestamptz not null default now()
+);
+CREATE INDEX withdrawal_reversals_withdrawal_id_idx ON withdrawal_reversals (withdrawal_id);
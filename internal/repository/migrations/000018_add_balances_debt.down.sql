@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS point_lots_number_idx;
+ALTER TABLE balances
+    DROP CONSTRAINT IF EXISTS balances_debt_check,
+    DROP COLUMN IF EXISTS debt;
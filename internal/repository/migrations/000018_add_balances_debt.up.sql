@@ -0,0 +1,5 @@
+ALTER TABLE balances
+    ADD COLUMN debt float not null default 0,
+    ADD CONSTRAINT balances_debt_check CHECK (debt >= 0);
+
+CREATE INDEX point_lots_number_idx ON point_lots (number);
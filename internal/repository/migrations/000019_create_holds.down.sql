@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS hold_lots;
+DROP TABLE IF EXISTS holds;
+
+UPDATE balances SET current=current+held;
+ALTER TABLE balances
+    DROP CONSTRAINT IF EXISTS balances_held_check,
+    DROP COLUMN IF EXISTS held;
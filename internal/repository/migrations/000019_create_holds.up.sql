@@ -0,0 +1,24 @@
+ALTER TABLE balances
+    ADD COLUMN held float not null default 0,
+    ADD CONSTRAINT balances_held_check CHECK (held >= 0);
+
+CREATE TABLE holds (
+id uuid primary key ,
+user_id uuid not null references users(id) ,
+number text not null ,
+sum float not null check (sum > 0) ,
+status text not null ,
+created_at timestamptz not null default now() ,
+expires_at timestamptz not null ,
+closed_at timestamptz
+);
+CREATE UNIQUE INDEX holds_number_key ON holds (number) WHERE status IN ('authorized', 'captured');
+CREATE INDEX holds_user_id_idx ON holds (user_id);
+CREATE INDEX holds_expires_at_idx ON holds (expires_at) WHERE status='authorized';
+
+CREATE TABLE hold_lots (
+hold_id uuid not null references holds(id) ,
+lot_id bigint not null references point_lots(id) ,
+amount float not null ,
+primary key (hold_id, lot_id)
+);
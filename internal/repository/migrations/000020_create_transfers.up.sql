@@ -0,0 +1,13 @@
+CREATE TABLE transfers (
+id uuid primary key ,
+from_user_id uuid not null references users(id) ,
+to_user_id uuid not null references users(id) ,
+sum float not null check (sum > 0) ,
+comment text not null default '' ,
+idempotency_key text not null ,
+created_at timestamptz not null default now() ,
+CONSTRAINT transfers_users_check CHECK (from_user_id <> to_user_id)
+);
+CREATE UNIQUE INDEX transfers_idempotency_key ON transfers (from_user_id, idempotency_key);
+CREATE INDEX transfers_from_user_id_idx ON transfers (from_user_id, created_at);
+CREATE INDEX transfers_to_user_id_idx ON transfers (to_user_id, created_at);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS point_lots_earned_at_idx;
+ALTER TABLE users
+    DROP COLUMN IF EXISTS tier_updated_at,
+    DROP COLUMN IF EXISTS tier;
@@ -0,0 +1,5 @@
+ALTER TABLE users
+    ADD COLUMN tier text not null default 'base',
+    ADD COLUMN tier_updated_at timestamptz;
+
+CREATE INDEX point_lots_earned_at_idx ON point_lots (user_id, earned_at) WHERE source='accrual';
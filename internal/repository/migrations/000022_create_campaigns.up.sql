@@ -0,0 +1,28 @@
+CREATE TABLE campaigns (
+id bigserial primary key ,
+name text not null ,
+starts_at timestamptz not null ,
+ends_at timestamptz not null ,
+min_orders int ,
+max_orders int ,
+min_accrual float ,
+tiers text[] not null default '{}' ,
+bonus_type text not null ,
+bonus_value float not null check (bonus_value > 0) ,
+active bool not null default true ,
+created_by text not null ,
+created_at timestamptz not null default now() ,
+CONSTRAINT campaigns_window_check CHECK (ends_at > starts_at)
+);
+CREATE INDEX campaigns_window_idx ON campaigns (starts_at, ends_at) WHERE active;
+
+CREATE TABLE campaign_bonuses (
+id bigserial primary key ,
+campaign_id bigint not null references campaigns(id) ,
+user_id uuid not null references users(id) ,
+number text not null ,
+amount float not null check (amount > 0) ,
+created_at timestamptz not null default now()
+);
+CREATE UNIQUE INDEX campaign_bonuses_number_key ON campaign_bonuses (campaign_id, number);
+CREATE INDEX campaign_bonuses_number_idx ON campaign_bonuses (number);
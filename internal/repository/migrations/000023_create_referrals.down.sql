@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS referrals;
+DROP INDEX IF EXISTS users_referral_code_key;
+ALTER TABLE users DROP COLUMN IF EXISTS registered_ip;
+ALTER TABLE users DROP COLUMN IF EXISTS referral_code;
@@ -0,0 +1,40 @@
+ALTER TABLE users ADD COLUMN referral_code text;
+ALTER TABLE users ADD COLUMN registered_ip text;
+CREATE UNIQUE INDEX users_referral_code_key ON users (referral_code);
+
+-- Existing users get codes of the alphabet new users get theirs from, a code
+-- taken already is drawn again.
+DO $$
+DECLARE
+    alphabet text := 'ABCDEFGHJKLMNPQRSTUVWXYZ23456789';
+    user_id uuid;
+BEGIN
+    FOR user_id IN SELECT id FROM users WHERE referral_code IS NULL LOOP
+        LOOP
+            BEGIN
+                UPDATE users
+                SET referral_code=(
+                    SELECT string_agg(substr(alphabet, 1 + floor(random() * 32)::int, 1), '')
+                    FROM generate_series(1, 8)
+                )
+                WHERE id=user_id;
+                EXIT;
+            EXCEPTION WHEN unique_violation THEN
+                NULL;
+            END;
+        END LOOP;
+    END LOOP;
+END $$;
+
+ALTER TABLE users ALTER COLUMN referral_code SET NOT NULL;
+
+CREATE TABLE referrals (
+referee_id uuid primary key references users(id) ,
+referrer_id uuid not null references users(id) ,
+number text ,
+amount float ,
+created_at timestamptz not null default now() ,
+rewarded_at timestamptz ,
+CONSTRAINT referrals_users_check CHECK (referrer_id <> referee_id)
+);
+CREATE INDEX referrals_referrer_id_idx ON referrals (referrer_id);
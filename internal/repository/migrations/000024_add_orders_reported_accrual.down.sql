@@ -0,0 +1,2 @@
+ALTER TABLE users ALTER COLUMN tier SET DEFAULT 'base';
+ALTER TABLE orders DROP COLUMN IF EXISTS reported_accrual;
@@ -0,0 +1,8 @@
+-- Tiers are reached by the accrual reported for orders, not by the credited
+-- one that already includes the tier multiplier. Orders credited before keep
+-- the credited accrual, the reported one was not stored.
+ALTER TABLE orders ADD COLUMN reported_accrual float;
+UPDATE orders SET reported_accrual=accrual WHERE checked AND accrual IS NOT NULL;
+
+-- New users get the lowest tier configured by TIERS.
+ALTER TABLE users ALTER COLUMN tier DROP DEFAULT;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idempotency_keys_created_at_idx;
+ALTER TABLE idempotency_keys DROP COLUMN IF EXISTS content_type;
@@ -0,0 +1,2 @@
+ALTER TABLE idempotency_keys ADD COLUMN content_type text;
+CREATE INDEX idempotency_keys_created_at_idx ON idempotency_keys (created_at);
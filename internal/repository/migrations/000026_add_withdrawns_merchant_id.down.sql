@@ -0,0 +1,2 @@
+ALTER TABLE holds DROP COLUMN IF EXISTS merchant_id;
+ALTER TABLE withdrawns DROP COLUMN IF EXISTS merchant_id;
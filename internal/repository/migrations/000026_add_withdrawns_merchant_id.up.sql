@@ -0,0 +1,4 @@
+-- A withdrawal is made at a merchant, the merchant may refund it. Withdrawals
+-- made before carry no merchant and are refunded by an admin only.
+ALTER TABLE withdrawns ADD COLUMN merchant_id uuid;
+ALTER TABLE holds ADD COLUMN merchant_id uuid;
@@ -2,19 +2,34 @@ package repository
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/jmoiron/sqlx"
 )
 
-func (s Store) Update(ctx context.Context, order Order) error {
+// Update stores the order polled from the accrual system, a status change is
+// added to the order history in the same transaction. The event is nil when
+// the status did not change.
+func (s Store) Update(ctx context.Context, order Order, event *OrderEvent, notify Notify[Order]) error {
+	tx, err := s.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("s.BeginTxx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
 	query := `
 	UPDATE orders
 	SET accrual=$1,status=$2,checked=$3
 	WHERE user_id=$4 AND number=$5`
-	res, err := s.ExecContext(ctx, query, order.Accrual, order.Status, order.Checked, order.UserID, order.Number)
+	res, err := tx.ExecContext(ctx, query, order.Accrual, order.Status, order.Checked, order.UserID, order.Number)
 	if err != nil {
-		return fmt.Errorf("s.QueryContext: %w", err)
+		return fmt.Errorf("tx.ExecContext: %w", err)
 	}
 
 	_, err = res.RowsAffected()
@@ -22,22 +37,167 @@ func (s Store) Update(ctx context.Context, order Order) error {
 		return fmt.Errorf("res.RowsAffected(): %w", err)
 	}
 
+	if event != nil {
+		if err = addOrderEvent(ctx, tx, *event); err != nil {
+			return fmt.Errorf("addOrderEvent: %w", err)
+		}
+	}
+
+	if err = enqueueWebhooks(ctx, tx, notify, order); err != nil {
+		return fmt.Errorf("enqueueWebhooks: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit: %w", err)
+	}
+
 	return nil
 }
 
-func (s Store) UpdateBalance(ctx context.Context, order Order) error {
+// UpdateBalance credits the order accrual with the campaign bonuses and records
+// each of them as a lot, the credit goes to pending while the lots are on hold.
+// The order is stored as credited in the same transaction and bonuses are
+// evaluated under the balance lock, so two orders credited at once never both
+// count as the first one. The event of the status change is nil when the
+// status did not change, like in Update. The order row is locked before the
+// balance, like in ClawbackOrder, and an order credited by another worker in
+// the meantime fails with oops.ErrOrderCredited before anything is written.
+func (s Store) UpdateBalance(
+	ctx context.Context,
+	order Order,
+	terms CreditTerms,
+	bonuses Bonuses,
+	event *OrderEvent,
+	notify Notify[Order],
+) error {
+	tx, err := s.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("s.BeginTxx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	queryLock := `
+	SELECT
+	    checked
+	FROM orders
+	WHERE number=$1
+	FOR UPDATE`
+
+	var checked bool
+	err = tx.GetContext(ctx, &checked, queryLock, order.Number)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return oops.ErrEmptyData
+		}
+		return fmt.Errorf("tx.GetContext: %w", err)
+	}
+
+	if checked {
+		return oops.ErrOrderCredited
+	}
+
+	if _, err = lockBalance(ctx, tx, order.UserID); err != nil {
+		return fmt.Errorf("lockBalance: %w", err)
+	}
+
+	var credited []Bonus
+	if bonuses != nil {
+		orders, err := creditedOrders(ctx, tx, order)
+		if err != nil {
+			return fmt.Errorf("creditedOrders: %w", err)
+		}
+
+		if credited, err = bonuses(orders + 1); err != nil {
+			return fmt.Errorf("bonuses: %w", err)
+		}
+	}
+
+	lot := PointLot{
+		UserID:    order.UserID,
+		Source:    LotSourceAccrual,
+		Number:    &order.Number,
+		Amount:    *order.Accrual,
+		ExpiresAt: terms.ExpiresAt,
+	}
+
 	query := `
 	UPDATE balances
 	SET current=current+$1
 	WHERE user_id=$2`
-	res, err := s.ExecContext(ctx, query, *order.Accrual, order.UserID)
+	if terms.AvailableAt != nil && terms.AvailableAt.After(time.Now()) {
+		lot.Pending = true
+		lot.AvailableAt = *terms.AvailableAt
+		query = `
+	UPDATE balances
+	SET pending=pending+$1
+	WHERE user_id=$2`
+	}
+
+	sum := *order.Accrual
+	for _, v := range credited {
+		sum += v.Amount
+	}
+
+	_, err = tx.ExecContext(ctx, query, sum, order.UserID)
 	if err != nil {
-		return fmt.Errorf("s.QueryContext: %w", err)
+		return fmt.Errorf("tx.ExecContext: %w", constraintError(err))
 	}
 
-	_, err = res.RowsAffected()
+	if err = addLot(ctx, tx, lot); err != nil {
+		return fmt.Errorf("addLot: %w", err)
+	}
+
+	if err = addBonuses(ctx, tx, order, lot, credited); err != nil {
+		return fmt.Errorf("addBonuses: %w", err)
+	}
+
+	queryOrder := `
+	UPDATE orders
+	SET accrual=$1,reported_accrual=$2,status=$3,checked=$4
+	WHERE number=$5`
+
+	_, err = tx.ExecContext(ctx, queryOrder,
+		order.Accrual, order.ReportedAccrual, order.Status, order.Checked, order.Number)
 	if err != nil {
-		return fmt.Errorf("res.RowsAffected(): %w", err)
+		return fmt.Errorf("tx.ExecContext: %w", err)
+	}
+
+	if !lot.Pending {
+		if _, err = settleDebt(ctx, tx, order.UserID); err != nil {
+			return fmt.Errorf("settleDebt: %w", err)
+		}
+	}
+
+	if event != nil {
+		if err = addOrderEvent(ctx, tx, *event); err != nil {
+			return fmt.Errorf("addOrderEvent: %w", err)
+		}
+	}
+
+	if err = enqueueWebhooks(ctx, tx, notify, order); err != nil {
+		return fmt.Errorf("enqueueWebhooks: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit: %w", err)
+	}
+
+	return nil
+}
+
+// addOrderEvent adds a status change to the order history in the transaction
+// of the change.
+func addOrderEvent(ctx context.Context, tx *sqlx.Tx, event OrderEvent) error {
+	query := `
+	INSERT INTO order_events(user_id,number,previous_status,status,accrual,payload,created_at)
+	VALUES ($1,$2,$3,$4,$5,NULLIF($6,'')::jsonb,NOW())`
+
+	_, err := tx.ExecContext(ctx, query,
+		event.UserID, event.Number, event.PreviousStatus, event.Status, event.Accrual, string(event.Payload))
+	if err != nil {
+		return fmt.Errorf("tx.ExecContext: %w", err)
 	}
 
 	return nil
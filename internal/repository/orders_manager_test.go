@@ -0,0 +1,101 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/google/uuid"
+)
+
+// TestUpdateBalanceConcurrent credits one order from two workers at once
+// against the database of DATABASE_URI, the accrual is credited exactly once.
+func TestUpdateBalanceConcurrent(t *testing.T) {
+	dsn, ok := os.LookupEnv("DATABASE_URI")
+	if !ok {
+		t.Skip("DATABASE_URI is not set")
+	}
+
+	store, err := New(Config{
+		ConnDSN:         dsn,
+		MaxConn:         20,
+		MaxConnLifeTime: time.Minute,
+		MaxConnIdleTime: time.Minute,
+		AutoMigrate:     true,
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	id := uuid.New()
+	err = store.Register(ctx, User{
+		ID:           id,
+		Login:        "credit-" + id.String(),
+		Password:     "password",
+		Token:        id.String(),
+		Tier:         "base",
+		ReferralCode: strings.ToUpper(id.String()[:8]),
+	})
+	if err != nil {
+		t.Fatalf("store.Register: %v", err)
+	}
+
+	order := Order{
+		UserID:     id,
+		Number:     fmt.Sprint(time.Now().UnixNano()),
+		Status:     OrderStatusNew,
+		UploadedAt: time.Now(),
+	}
+	if err = store.CreateOrder(ctx, order); err != nil {
+		t.Fatalf("store.CreateOrder: %v", err)
+	}
+
+	accrual := float32(100)
+	order.Status = "PROCESSED"
+	order.Accrual = &accrual
+	order.ReportedAccrual = &accrual
+	order.Checked = true
+
+	const workers = 2
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			errs[i] = store.UpdateBalance(ctx, order, CreditTerms{}, nil, nil, nil)
+		}(i)
+	}
+	wg.Wait()
+
+	var credited int
+	for i, err := range errs {
+		if err == nil {
+			credited++
+			continue
+		}
+		if !errors.Is(err, oops.ErrOrderCredited) {
+			t.Fatalf("worker %d: %v", i, err)
+		}
+	}
+	if credited != 1 {
+		t.Fatalf("credited %d times, wants 1", credited)
+	}
+
+	balance, err := store.Balance(ctx, id)
+	if err != nil {
+		t.Fatalf("store.Balance: %v", err)
+	}
+	if balance.Current != accrual {
+		t.Errorf("balance current = %v, wants %v", balance.Current, accrual)
+	}
+}
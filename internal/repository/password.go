@@ -0,0 +1,157 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/google/uuid"
+)
+
+type PasswordReset struct {
+	TokenHash string    `db:"token_hash"`
+	UserID    uuid.UUID `db:"user_id"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+func (s Store) UserByLogin(ctx context.Context, login string) (User, error) {
+	query := `
+	SELECT
+	    id,
+	    login,
+	    blocked
+	FROM users
+	WHERE lower(login)=$1`
+
+	var users []User
+	err := s.SelectContext(ctx, &users, query, login)
+	if err != nil {
+		return User{}, fmt.Errorf("s.SelectContext: %w", err)
+	}
+
+	if users == nil {
+		return User{}, oops.ErrUserNotFound
+	}
+
+	return users[0], nil
+}
+
+func (s Store) UserByID(ctx context.Context, id uuid.UUID) (User, error) {
+	query := `
+	SELECT
+	    id,
+	    login,
+	    blocked
+	FROM users
+	WHERE id=$1`
+
+	var users []User
+	err := s.SelectContext(ctx, &users, query, id)
+	if err != nil {
+		return User{}, fmt.Errorf("s.SelectContext: %w", err)
+	}
+
+	if users == nil {
+		return User{}, oops.ErrUserNotFound
+	}
+
+	return users[0], nil
+}
+
+// ChangePassword replaces the password and the token when the current
+// password matches, the old token stops working at once.
+func (s Store) ChangePassword(ctx context.Context, id uuid.UUID, current string, user User) error {
+	query := `
+	UPDATE users
+	SET password=$1,token=$2
+	WHERE id=$3 AND password=$4`
+
+	res, err := s.ExecContext(ctx, query, user.Password, user.Token, id, current)
+	if err != nil {
+		return fmt.Errorf("s.ExecContext: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("res.RowsAffected(): %w", err)
+	}
+
+	if n == 0 {
+		return oops.ErrInvalidCredentials
+	}
+
+	return nil
+}
+
+func (s Store) CreatePasswordReset(ctx context.Context, reset PasswordReset) error {
+	query := `
+	INSERT INTO password_resets(token_hash,user_id,expires_at,created_at)
+	VALUES ($1,$2,$3,NOW())`
+
+	res, err := s.ExecContext(ctx, query, reset.TokenHash, reset.UserID, reset.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("s.ExecContext: %w", err)
+	}
+
+	_, err = res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("res.RowsAffected(): %w", err)
+	}
+
+	return nil
+}
+
+// ResetPassword consumes a live reset token, sets the new password and token
+// and invalidates the other reset tokens of the user.
+func (s Store) ResetPassword(ctx context.Context, tokenHash string, user User) error {
+	tx, err := s.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("s.BeginTxx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	queryReset := `
+	UPDATE password_resets
+	SET used_at=NOW()
+	WHERE token_hash=$1 AND used_at IS NULL AND expires_at > NOW()
+	RETURNING user_id`
+
+	var ids []uuid.UUID
+	err = tx.SelectContext(ctx, &ids, queryReset, tokenHash)
+	if err != nil {
+		return fmt.Errorf("tx.SelectContext: %w", err)
+	}
+
+	if ids == nil {
+		return oops.ErrInvalidToken
+	}
+
+	queryUser := `
+	UPDATE users
+	SET password=$1,token=$2
+	WHERE id=$3`
+
+	_, err = tx.ExecContext(ctx, queryUser, user.Password, user.Token, ids[0])
+	if err != nil {
+		return fmt.Errorf("tx.ExecContext: %w", err)
+	}
+
+	queryOthers := `
+	UPDATE password_resets
+	SET used_at=NOW()
+	WHERE user_id=$1 AND used_at IS NULL`
+
+	_, err = tx.ExecContext(ctx, queryOthers, ids[0])
+	if err != nil {
+		return fmt.Errorf("tx.ExecContext: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,299 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+const LotSourceReferral = "referral"
+
+// ReferralReward credits Amount to the referee and to the referrer for the
+// order Number of the referee. A referrer rewarded MaxRewards times already
+// gets no more rewards, zero means no limit.
+type ReferralReward struct {
+	RefereeID  uuid.UUID
+	Number     string
+	Amount     float32
+	MaxRewards int
+	Terms      CreditTerms
+}
+
+// Referral is the reward of a referral credited for an order of the referee.
+type Referral struct {
+	ReferrerID uuid.UUID `db:"referrer_id"`
+	Amount     float32   `db:"amount"`
+}
+
+type ReferralStats struct {
+	Code     string `db:"referral_code"`
+	Invited  int    `db:"invited"`
+	Rewarded int    `db:"rewarded"`
+}
+
+// addReferral links the new user to the owner of the code the user registered
+// with. Blocked referrers are refused. Nothing else about the referrer may
+// change the answer to a registration, it would tell strangers about the
+// account. Owners inviting themselves are limited by the rewards cap of
+// RewardReferral, addresses are shared behind NAT and proxies and only recorded.
+func addReferral(ctx context.Context, tx *sqlx.Tx, user User) error {
+	queryReferrer := `
+	SELECT
+	    id,
+	    blocked
+	FROM users
+	WHERE referral_code=$1`
+
+	var referrer User
+	err := tx.GetContext(ctx, &referrer, queryReferrer, user.ReferredBy)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return oops.ErrReferralInvalid
+		}
+		return fmt.Errorf("tx.GetContext: %w", err)
+	}
+
+	if referrer.Blocked {
+		return oops.ErrReferralInvalid
+	}
+
+	query := `
+	INSERT INTO referrals(referee_id,referrer_id,created_at)
+	VALUES ($1,$2,NOW())`
+
+	_, err = tx.ExecContext(ctx, query, user.ID, referrer.ID)
+	if err != nil {
+		return fmt.Errorf("tx.ExecContext: %w", constraintError(err))
+	}
+
+	return nil
+}
+
+// RewardReferral credits the referral bonus to both users once per referral,
+// the caller makes sure Number is the first order of the referee credited. A
+// clawback of that order takes the bonus back and lets the next order earn it.
+// Both balances are locked in the order of their ids like in Transfer. It
+// returns the referrer id with the referrer and the referee balances, and
+// oops.ErrEmptyData when there is nothing to reward. notify gets the referrer id.
+func (s Store) RewardReferral(
+	ctx context.Context,
+	r ReferralReward,
+	notify Notify[uuid.UUID],
+) (uuid.UUID, Balance, Balance, error) {
+	tx, err := s.BeginTxx(ctx, nil)
+	if err != nil {
+		return uuid.Nil, Balance{}, Balance{}, fmt.Errorf("s.BeginTxx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	queryReferral := `
+	SELECT
+	    r.referrer_id
+	FROM referrals r
+	JOIN users u ON u.id=r.referrer_id
+	WHERE r.referee_id=$1 AND r.rewarded_at IS NULL AND NOT u.blocked
+	FOR UPDATE OF r`
+
+	var referrerID uuid.UUID
+	err = tx.GetContext(ctx, &referrerID, queryReferral, r.RefereeID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return uuid.Nil, Balance{}, Balance{}, oops.ErrEmptyData
+		}
+		return uuid.Nil, Balance{}, Balance{}, fmt.Errorf("tx.GetContext: %w", err)
+	}
+
+	first, second := referrerID, r.RefereeID
+	if second.String() < first.String() {
+		first, second = second, first
+	}
+
+	if _, err = lockBalance(ctx, tx, first); err != nil {
+		return uuid.Nil, Balance{}, Balance{}, fmt.Errorf("lockBalance: %w", err)
+	}
+	if _, err = lockBalance(ctx, tx, second); err != nil {
+		return uuid.Nil, Balance{}, Balance{}, fmt.Errorf("lockBalance: %w", err)
+	}
+
+	// The referrer balance lock orders the rewards of one referrer, so the cap
+	// holds under concurrent orders of several referees.
+	if r.MaxRewards > 0 {
+		queryCount := `
+	SELECT
+	    count(*)
+	FROM referrals
+	WHERE referrer_id=$1 AND rewarded_at IS NOT NULL`
+
+		var rewarded int
+		err = tx.GetContext(ctx, &rewarded, queryCount, referrerID)
+		if err != nil {
+			return uuid.Nil, Balance{}, Balance{}, fmt.Errorf("tx.GetContext: %w", err)
+		}
+
+		if rewarded >= r.MaxRewards {
+			return uuid.Nil, Balance{}, Balance{}, oops.ErrEmptyData
+		}
+	}
+
+	lot := PointLot{
+		Source:    LotSourceReferral,
+		Number:    &r.Number,
+		Amount:    r.Amount,
+		ExpiresAt: r.Terms.ExpiresAt,
+	}
+	if r.Terms.AvailableAt != nil && r.Terms.AvailableAt.After(time.Now()) {
+		lot.Pending = true
+		lot.AvailableAt = *r.Terms.AvailableAt
+	}
+
+	lot.UserID = referrerID
+	referrer, err := credit(ctx, tx, lot)
+	if err != nil {
+		return uuid.Nil, Balance{}, Balance{}, fmt.Errorf("credit: %w", err)
+	}
+
+	lot.UserID = r.RefereeID
+	referee, err := credit(ctx, tx, lot)
+	if err != nil {
+		return uuid.Nil, Balance{}, Balance{}, fmt.Errorf("credit: %w", err)
+	}
+
+	queryRewarded := `
+	UPDATE referrals
+	SET number=$1,amount=$2,rewarded_at=NOW()
+	WHERE referee_id=$3`
+
+	_, err = tx.ExecContext(ctx, queryRewarded, r.Number, r.Amount, r.RefereeID)
+	if err != nil {
+		return uuid.Nil, Balance{}, Balance{}, fmt.Errorf("tx.ExecContext: %w", err)
+	}
+
+	if err = enqueueWebhooks(ctx, tx, notify, referrerID); err != nil {
+		return uuid.Nil, Balance{}, Balance{}, fmt.Errorf("enqueueWebhooks: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return uuid.Nil, Balance{}, Balance{}, fmt.Errorf("tx.Commit: %w", err)
+	}
+
+	return referrerID, referrer, referee, nil
+}
+
+// orderReferral returns the referral rewarded for the order of the referee and
+// locks it, false when the order earned none.
+func orderReferral(ctx context.Context, tx *sqlx.Tx, order Order) (Referral, bool, error) {
+	query := `
+	SELECT
+	    referrer_id,
+	    amount
+	FROM referrals
+	WHERE referee_id=$1 AND number=$2 AND rewarded_at IS NOT NULL
+	FOR UPDATE`
+
+	var referral Referral
+	err := tx.GetContext(ctx, &referral, query, order.UserID, order.Number)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Referral{}, false, nil
+		}
+		return Referral{}, false, fmt.Errorf("tx.GetContext: %w", err)
+	}
+
+	return referral, true, nil
+}
+
+// takeBackReferral debits the referrer for the cancelled order of the referee
+// and leaves the referral to be rewarded by a later order. The referee part is
+// taken back with the order, both balances must be locked.
+func takeBackReferral(ctx context.Context, tx *sqlx.Tx, order Order, referral Referral) error {
+	balance, err := lockBalance(ctx, tx, referral.ReferrerID)
+	if err != nil {
+		return fmt.Errorf("lockBalance: %w", err)
+	}
+
+	referrer := Order{UserID: referral.ReferrerID, Number: order.Number}
+	if _, err = takeBack(ctx, tx, referrer, referral.Amount, balance); err != nil {
+		return fmt.Errorf("takeBack: %w", err)
+	}
+
+	query := `
+	UPDATE referrals
+	SET number=NULL,amount=NULL,rewarded_at=NULL
+	WHERE referee_id=$1`
+
+	_, err = tx.ExecContext(ctx, query, order.UserID)
+	if err != nil {
+		return fmt.Errorf("tx.ExecContext: %w", err)
+	}
+
+	return nil
+}
+
+// credit adds the lot to the locked balance of its user, to pending for a
+// pending lot, and returns the new balance.
+func credit(ctx context.Context, tx *sqlx.Tx, lot PointLot) (Balance, error) {
+	query := `
+	UPDATE balances
+	SET current=current+$1
+	WHERE user_id=$2
+	RETURNING user_id, current, pending, held, withdrawn, debt`
+	if lot.Pending {
+		query = `
+	UPDATE balances
+	SET pending=pending+$1
+	WHERE user_id=$2
+	RETURNING user_id, current, pending, held, withdrawn, debt`
+	}
+
+	var balance Balance
+	err := tx.GetContext(ctx, &balance, query, lot.Amount, lot.UserID)
+	if err != nil {
+		return Balance{}, fmt.Errorf("tx.GetContext: %w", err)
+	}
+
+	if err = addLot(ctx, tx, lot); err != nil {
+		return Balance{}, fmt.Errorf("addLot: %w", err)
+	}
+
+	if lot.Pending {
+		return balance, nil
+	}
+
+	balance, err = settleDebt(ctx, tx, lot.UserID)
+	if err != nil {
+		return Balance{}, fmt.Errorf("settleDebt: %w", err)
+	}
+
+	return balance, nil
+}
+
+func (s Store) ReferralStats(ctx context.Context, id uuid.UUID) (ReferralStats, error) {
+	query := `
+	SELECT
+	    u.referral_code,
+	    count(r.referee_id) AS invited,
+	    count(r.rewarded_at) AS rewarded
+	FROM users u
+	LEFT JOIN referrals r ON r.referrer_id=u.id
+	WHERE u.id=$1
+	GROUP BY u.id`
+
+	var stats ReferralStats
+	err := s.GetContext(ctx, &stats, query, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ReferralStats{}, oops.ErrUserNotFound
+		}
+		return ReferralStats{}, fmt.Errorf("s.GetContext: %w", err)
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,207 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/1Asi1/gophermart/internal/models"
+	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+// Reversal refunds Amount of the withdrawal made for Number, zero refunds
+// everything not refunded yet. A reversal asked for by a merchant has its
+// MerchantID and only finds the withdrawals made at that merchant.
+type Reversal struct {
+	Number     string     `db:"number"`
+	Amount     float32    `db:"amount"`
+	Reason     string     `db:"reason"`
+	Operator   string     `db:"operator"`
+	MerchantID *uuid.UUID `db:"-"`
+	ExpiresAt  *time.Time `db:"-"`
+}
+
+// Reversed is the withdrawal after the reversal with the amount refunded.
+type Reversed struct {
+	Withdrawal Withdrawals
+	Amount     float32
+}
+
+// ReverseWithdrawal returns points of a withdrawal to the balance as a new lot
+// and records the reversal, the withdrawal and balance rows stay locked for
+// the whole transaction so refunds never exceed the withdrawn sum. A zero
+// Reversal.Amount refunds what is left, the audit gets the amount refunded.
+func (s Store) ReverseWithdrawal(
+	ctx context.Context,
+	rev Reversal,
+	notify Notify[Withdrawals],
+	audit Audit[Reversed],
+) (Withdrawals, Balance, error) {
+	tx, err := s.BeginTxx(ctx, nil)
+	if err != nil {
+		return Withdrawals{}, Balance{}, fmt.Errorf("s.BeginTxx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	queryWithdrawal := `
+	SELECT
+	    id,
+	    user_id,
+	    number,
+	    sum,
+	    merchant_id,
+	    status,
+	    reversed,
+	    processed_at
+	FROM withdrawns
+	WHERE number=$1
+	FOR UPDATE`
+
+	var withdrawal Withdrawals
+	err = tx.GetContext(ctx, &withdrawal, queryWithdrawal, rev.Number)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Withdrawals{}, Balance{}, oops.ErrWithdrawalNotFound
+		}
+		return Withdrawals{}, Balance{}, fmt.Errorf("tx.GetContext: %w", err)
+	}
+
+	// A withdrawal made at another merchant is as unknown to the merchant as a
+	// missing one.
+	if rev.MerchantID != nil && (withdrawal.MerchantID == nil || *withdrawal.MerchantID != *rev.MerchantID) {
+		return Withdrawals{}, Balance{}, oops.ErrWithdrawalNotFound
+	}
+
+	left := withdrawal.Sum - withdrawal.Reversed
+	amount := rev.Amount
+	if amount == 0 {
+		amount = left
+	}
+	if amount <= 0 || cents(amount) > cents(left) {
+		return Withdrawals{}, Balance{}, oops.ErrReversalInvalid
+	}
+
+	locked, err := lockBalance(ctx, tx, withdrawal.UserID)
+	if err != nil {
+		return Withdrawals{}, Balance{}, fmt.Errorf("lockBalance: %w", err)
+	}
+
+	// The balance has withdrawn at least what is left of the withdrawal, less
+	// is drift the ledger must be repaired for.
+	if cents(locked.Withdrawn) < cents(amount) {
+		return Withdrawals{}, Balance{}, fmt.Errorf("%w: the balance has withdrawn %.2f, the refund %.2f",
+			oops.ErrBalanceDrift, locked.Withdrawn, amount)
+	}
+
+	queryBalance := `
+	UPDATE balances
+	SET
+	    current=current+$1,
+	    withdrawn=withdrawn-$1
+	WHERE user_id=$2
+	RETURNING user_id, current, pending, held, withdrawn, debt`
+
+	var balance Balance
+	err = tx.GetContext(ctx, &balance, queryBalance, amount, withdrawal.UserID)
+	if err != nil {
+		return Withdrawals{}, Balance{}, fmt.Errorf("tx.GetContext: %w", constraintError(err))
+	}
+
+	err = addLot(ctx, tx, PointLot{
+		UserID:    withdrawal.UserID,
+		Source:    LotSourceRefund,
+		Number:    &withdrawal.Number,
+		Amount:    amount,
+		ExpiresAt: rev.ExpiresAt,
+	})
+	if err != nil {
+		return Withdrawals{}, Balance{}, fmt.Errorf("addLot: %w", err)
+	}
+
+	balance, err = settleDebt(ctx, tx, withdrawal.UserID)
+	if err != nil {
+		return Withdrawals{}, Balance{}, fmt.Errorf("settleDebt: %w", err)
+	}
+
+	withdrawal.Reversed += amount
+	withdrawal.Status = WithdrawalStatusPartiallyReversed
+	if cents(withdrawal.Reversed) >= cents(withdrawal.Sum) {
+		withdrawal.Reversed = withdrawal.Sum
+		withdrawal.Status = WithdrawalStatusReversed
+	}
+
+	queryWithdrawalUpdate := `
+	UPDATE withdrawns
+	SET status=$1,reversed=$2
+	WHERE id=$3`
+
+	_, err = tx.ExecContext(ctx, queryWithdrawalUpdate, withdrawal.Status, withdrawal.Reversed, withdrawal.ID)
+	if err != nil {
+		return Withdrawals{}, Balance{}, fmt.Errorf("tx.ExecContext: %w", err)
+	}
+
+	queryReversal := `
+	INSERT INTO withdrawal_reversals(withdrawal_id,user_id,amount,reason,operator,created_at)
+	VALUES ($1,$2,$3,$4,$5,NOW())`
+
+	_, err = tx.ExecContext(ctx, queryReversal, withdrawal.ID, withdrawal.UserID, amount, rev.Reason, rev.Operator)
+	if err != nil {
+		return Withdrawals{}, Balance{}, fmt.Errorf("tx.ExecContext: %w", err)
+	}
+
+	if err = enqueueWebhooks(ctx, tx, notify, withdrawal); err != nil {
+		return Withdrawals{}, Balance{}, fmt.Errorf("enqueueWebhooks: %w", err)
+	}
+
+	if err = addAuditLog(ctx, tx, audit, Reversed{Withdrawal: withdrawal, Amount: amount}); err != nil {
+		return Withdrawals{}, Balance{}, fmt.Errorf("addAuditLog: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Withdrawals{}, Balance{}, fmt.Errorf("tx.Commit: %w", err)
+	}
+
+	return withdrawal, balance, nil
+}
+
+// cents compares sums at the precision they are accepted with, float
+// arithmetic on them is off by a fraction.
+func cents(sum float32) int64 {
+	return int64(math.Round(float64(sum) * 100))
+}
+
+func roundCents(sum float32) float32 {
+	return float32(cents(sum)) / 100
+}
+
+// checkMerchant refuses a merchant that is neither a merchant user nor a live
+// API key, nil is no merchant.
+func checkMerchant(ctx context.Context, tx *sqlx.Tx, id *uuid.UUID) error {
+	if id == nil {
+		return nil
+	}
+
+	query := `
+	SELECT
+	    EXISTS (SELECT 1 FROM users WHERE id=$1 AND role=$2)
+	    OR EXISTS (SELECT 1 FROM api_keys WHERE id=$1 AND revoked_at IS NULL)`
+
+	var ok bool
+	err := tx.GetContext(ctx, &ok, query, *id, models.RoleMerchant)
+	if err != nil {
+		return fmt.Errorf("tx.GetContext: %w", err)
+	}
+
+	if !ok {
+		return oops.ErrMerchantNotFound
+	}
+
+	return nil
+}
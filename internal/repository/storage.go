@@ -1,9 +1,11 @@
 package repository
 
 import (
+	"database/sql"
 	"embed"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/1Asi1/gophermart/internal/oops"
@@ -11,38 +13,83 @@ import (
 	_ "github.com/golang-migrate/migrate/v4/database/postgres"
 	"github.com/golang-migrate/migrate/v4/source/iofs"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx"
 	_ "github.com/jackc/pgx/stdlib"
 	"github.com/jmoiron/sqlx"
 	"golang.org/x/net/context"
 )
 
 type User struct {
-	ID       uuid.UUID `db:"id"`
-	Login    string    `db:"login"`
-	Password string    `db:"password"`
-	Token    string    `db:"token"`
+	ID          uuid.UUID `db:"id"`
+	Login       string    `db:"login"`
+	Password    string    `db:"password"`
+	Token       string    `db:"token"`
+	Blocked     bool      `db:"blocked"`
+	Role        string    `db:"role"`
+	Tier        string    `db:"tier"`
+	Permissions TextArray `db:"permissions"`
+	// ReferralCode is given to the user at registration, ReferredBy is the
+	// code the user registered with.
+	ReferralCode string `db:"referral_code"`
+	ReferredBy   string `db:"-"`
+	RegisteredIP string `db:"registered_ip"`
 }
 
+// Order keeps the credited accrual in Accrual, ReportedAccrual is what the
+// accrual system reported before the tier multiplier.
 type Order struct {
-	UserID     uuid.UUID `db:"user_id"`
-	Number     string    `db:"number"`
-	Status     string    `db:"status"`
-	Accrual    *float32  `db:"accrual"`
-	UploadedAt time.Time `db:"uploaded_at"`
-	Checked    bool      `db:"checked"`
+	UserID          uuid.UUID `db:"user_id"`
+	Number          string    `db:"number"`
+	Status          string    `db:"status"`
+	Accrual         *float32  `db:"accrual"`
+	ReportedAccrual *float32  `db:"reported_accrual"`
+	UploadedAt      time.Time `db:"uploaded_at"`
+	Checked         bool      `db:"checked"`
 }
 
+// Balance keeps credits still on hold in Pending, only Current can be spent.
+// Debt is what a clawback could not take and is paid off by later credits,
+// Held is reserved by authorized holds and already taken off Current.
 type Balance struct {
 	UserID    uuid.UUID `db:"user_id"`
 	Current   float32   `db:"current"`
+	Pending   float32   `db:"pending"`
+	Held      float32   `db:"held"`
 	Withdrawn float32   `db:"withdrawn"`
+	Debt      float32   `db:"debt"`
 }
 
+const (
+	WithdrawalStatusCompleted         = "completed"
+	WithdrawalStatusPartiallyReversed = "partially_reversed"
+	WithdrawalStatusReversed          = "reversed"
+)
+
 type Withdrawals struct {
-	UserID      uuid.UUID `db:"user_id"`
-	Number      string    `db:"number"`
-	Sum         float32   `db:"sum"`
-	ProcessedAt time.Time `db:"processed_at"`
+	ID          int64      `db:"id"`
+	UserID      uuid.UUID  `db:"user_id"`
+	Number      string     `db:"number"`
+	Sum         float32    `db:"sum"`
+	MerchantID  *uuid.UUID `db:"merchant_id"`
+	Status      string     `db:"status"`
+	Reversed    float32    `db:"reversed"`
+	ProcessedAt time.Time  `db:"processed_at"`
+}
+
+type OrderUpload struct {
+	Number string `db:"number"`
+	Result string `db:"result"`
+}
+
+type OrderEvent struct {
+	ID             int64     `db:"id"`
+	UserID         uuid.UUID `db:"user_id"`
+	Number         string    `db:"number"`
+	PreviousStatus string    `db:"previous_status"`
+	Status         string    `db:"status"`
+	Accrual        *float32  `db:"accrual"`
+	Payload        []byte    `db:"payload"`
+	CreatedAt      time.Time `db:"created_at"`
 }
 
 type Config struct {
@@ -50,6 +97,7 @@ type Config struct {
 	MaxConn         int
 	MaxConnLifeTime time.Duration
 	MaxConnIdleTime time.Duration
+	AutoMigrate     bool
 }
 
 //go:embed migrations/*.sql
@@ -71,23 +119,38 @@ func New(cfg Config) (Store, error) {
 		return Store{}, fmt.Errorf("db.Ping :%w", err)
 	}
 
-	if err = runMigrations(cfg.ConnDSN); err != nil {
-		return Store{}, fmt.Errorf("runMigrations :%w", err)
+	if cfg.AutoMigrate {
+		if err = runMigrations(cfg.ConnDSN); err != nil {
+			return Store{}, fmt.Errorf("runMigrations :%w", err)
+		}
 	}
 
 	return Store{db}, nil
 }
 
-func runMigrations(dsn string) error {
+// NewMigrate returns a migrate instance over the embedded migrations,
+// the caller must Close it.
+func NewMigrate(dsn string) (*migrate.Migrate, error) {
 	d, err := iofs.New(migrationsDir, "migrations")
 	if err != nil {
-		return fmt.Errorf("failed to return an iofs driver: %w", err)
+		return nil, fmt.Errorf("failed to return an iofs driver: %w", err)
 	}
 
 	m, err := migrate.NewWithSourceInstance("iofs", d, dsn)
 	if err != nil {
-		return fmt.Errorf("failed to get a new migrate instance: %w", err)
+		return nil, fmt.Errorf("failed to get a new migrate instance: %w", err)
 	}
+
+	return m, nil
+}
+
+func runMigrations(dsn string) error {
+	m, err := NewMigrate(dsn)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
 	if err = m.Up(); err != nil {
 		if !errors.Is(err, migrate.ErrNoChange) {
 			return fmt.Errorf("failed to apply migrations to the DB: %w", err)
@@ -96,126 +159,224 @@ func runMigrations(dsn string) error {
 	return nil
 }
 
-func (s Store) Register(ctx context.Context, user User) error {
-	query := `
-	INSERT INTO users(id,login,password,token)
-	VALUES (:id,:login,:password,:token)`
+var constraintErrors = map[string]error{
+	"users_login_key":           oops.ErrLoginTaken,
+	"users_login_lower_key":     oops.ErrLoginTaken,
+	"orders_pkey":               oops.ErrOrderReady,
+	"orders_user_id_fkey":       oops.ErrUserNotFound,
+	"balances_user_id_fkey":     oops.ErrUserNotFound,
+	"balances_current_check":    oops.ErrInsufficientFunds,
+	"withdrawns_number_key":     oops.ErrWithdrawExists,
+	"withdrawns_user_id_fkey":   oops.ErrUserNotFound,
+	"holds_number_key":          oops.ErrHoldExists,
+	"transfers_idempotency_key": oops.ErrTransferExists,
+	"transfers_to_user_id_fkey": oops.ErrUserNotFound,
+	"transfers_users_check":     oops.ErrTransferInvalid,
+	"referrals_users_check":     oops.ErrReferralInvalid,
+	"users_referral_code_key":   oops.ErrReferralCodeTaken,
+}
+
+// constraintError maps a constraint violation to its domain error, other
+// errors are returned as is.
+func constraintError(err error) error {
+	var pgErr pgx.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+
+	if mapped, ok := constraintErrors[pgErr.ConstraintName]; ok {
+		return fmt.Errorf("%w: %w", mapped, err)
+	}
+
+	return err
+}
 
-	resRegister, err := s.NamedExecContext(ctx, query, &user)
+// Register creates the user together with its balance row in one transaction.
+func (s Store) Register(ctx context.Context, user User) error {
+	tx, err := s.BeginTxx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("s.NamedExecContext: %w", err)
+		return fmt.Errorf("s.BeginTxx: %w", err)
 	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	query := `
+	INSERT INTO users(id,login,password,token,tier,referral_code,registered_ip)
+	VALUES (:id,:login,:password,:token,:tier,:referral_code,NULLIF(:registered_ip,''))`
 
-	if _, err = resRegister.RowsAffected(); err != nil {
-		return fmt.Errorf("resRegister.RowsAffected(): %w", err)
+	_, err = tx.NamedExecContext(ctx, query, &user)
+	if err != nil {
+		return fmt.Errorf("tx.NamedExecContext: %w", constraintError(err))
 	}
 
 	query = `
 	INSERT INTO balances(user_id)
 	VALUES ($1)`
 
-	resBalance, err := s.ExecContext(ctx, query, user.ID)
+	_, err = tx.ExecContext(ctx, query, user.ID)
 	if err != nil {
-		return fmt.Errorf("s.ExecContext: %w", err)
+		return fmt.Errorf("tx.ExecContext: %w", constraintError(err))
+	}
+
+	if user.ReferredBy != "" {
+		if err = addReferral(ctx, tx, user); err != nil {
+			return fmt.Errorf("addReferral: %w", err)
+		}
 	}
 
-	if _, err = resBalance.RowsAffected(); err != nil {
-		return fmt.Errorf("resBalance.RowsAffected: %w", err)
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit: %w", err)
 	}
 
 	return nil
 }
 
+// RepairBalances creates the balance rows missing for existing users and
+// returns how many were created.
+func (s Store) RepairBalances(ctx context.Context) (int64, error) {
+	query := `
+	INSERT INTO balances(user_id)
+	SELECT id
+	FROM users u
+	WHERE NOT EXISTS (SELECT 1 FROM balances b WHERE b.user_id=u.id)`
+
+	res, err := s.ExecContext(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("s.ExecContext: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("res.RowsAffected(): %w", err)
+	}
+
+	return n, nil
+}
+
 func (s Store) Login(ctx context.Context, user User) (string, error) {
 	query := `
 	SELECT
-	    token
+	    token,
+	    blocked
 	FROM users
-	WHERE login=$1 AND password=$2`
+	WHERE lower(login)=$1 AND password=$2`
 
-	rows, err := s.QueryContext(ctx, query, user.Login, user.Password)
+	var users []User
+	err := s.SelectContext(ctx, &users, query, user.Login, user.Password)
 	if err != nil {
-		return "", fmt.Errorf("s.QueryContext: %w", err)
+		return "", fmt.Errorf("s.SelectContext: %w", err)
 	}
-	err = rows.Err()
-	if err != nil {
-		return "", fmt.Errorf("rows.Err: %w", err)
+
+	if users == nil {
+		return "", oops.ErrInvalidCredentials
 	}
 
-	var token string
-	for rows.Next() {
-		err = rows.Scan(&token)
-		if err != nil {
-			return "", fmt.Errorf("rows.Scan: %w", err)
-		}
+	if users[0].Blocked {
+		return "", oops.ErrUserBlocked
 	}
-	defer func() {
-		err = rows.Close()
-	}()
 
-	return token, nil
+	return users[0].Token, nil
 }
 
-func (s Store) CheckToken(ctx context.Context, token string) (uuid.UUID, error) {
+func (s Store) CheckToken(ctx context.Context, token string) (User, error) {
 	query := `
 	SELECT
-	    id
+	    id,
+	    login,
+	    blocked,
+	    role,
+	    permissions
 	FROM users
 	WHERE token=$1`
 
-	var id []uuid.UUID
-	err := s.SelectContext(ctx, &id, query, token)
+	var users []User
+	err := s.SelectContext(ctx, &users, query, token)
 	if err != nil {
-		return uuid.UUID{}, fmt.Errorf("s.SelectContext: %w", err)
+		return User{}, fmt.Errorf("s.SelectContext: %w", err)
+	}
+
+	if users == nil {
+		return User{}, oops.ErrInvalidToken
 	}
 
-	if id == nil {
-		return uuid.UUID{}, oops.ErrInvalidToken
+	if users[0].Blocked {
+		return User{}, oops.ErrUserBlocked
 	}
 
-	return id[0], nil
+	return users[0], nil
 }
 
+// CreateOrder inserts the order or, when the number is taken, tells whose it is.
+// The insert and the conflict check are one statement, so concurrent uploads
+// of the same number cannot both succeed.
 func (s Store) CreateOrder(ctx context.Context, order Order) error {
-	queryChekOrder := `
+	query := `
+	INSERT INTO orders(user_id,number,status,accrual,uploaded_at,checked)
+	VALUES ($1,$2,$3,$4,$5,$6)
+	ON CONFLICT (number) DO NOTHING
+	RETURNING user_id`
+
+	var owner uuid.UUID
+	err := s.QueryRowContext(ctx, query,
+		order.UserID, order.Number, order.Status, order.Accrual, order.UploadedAt, order.Checked).Scan(&owner)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("s.QueryRowContext: %w", constraintError(err))
+	}
+
+	queryOwner := `
 	SELECT
-	    user_id,
-		number
+	    user_id
 	FROM orders
-	WHERE user_id=$1 and number=$2
-	OR number=$2`
+	WHERE number=$1`
 
-	row := s.QueryRowContext(ctx, queryChekOrder, order.UserID, order.Number)
-	err := row.Err()
+	err = s.QueryRowContext(ctx, queryOwner, order.Number).Scan(&owner)
 	if err != nil {
 		return fmt.Errorf("s.QueryRowContext: %w", err)
 	}
 
-	var chek Order
-	_ = row.Scan(&chek.UserID, &chek.Number)
-
-	if chek.UserID == order.UserID && chek.Number == order.Number {
+	if owner == order.UserID {
 		return oops.ErrOrderCreate
 	}
 
-	if chek.UserID != order.UserID && chek.Number == order.Number {
-		return oops.ErrOrderReady
-	}
+	return oops.ErrOrderReady
+}
 
+// CreateOrders uploads numbers in a single statement and reports for each
+// number whether it was inserted or who owns it already. Numbers must be
+// validated digit strings, they are passed as an array literal.
+func (s Store) CreateOrders(ctx context.Context, id uuid.UUID, numbers []string) ([]OrderUpload, error) {
 	query := `
-	INSERT INTO orders(user_id,number,status,accrual,uploaded_at,checked)
-	VALUES (:user_id,:number,:status,:accrual,:uploaded_at,:checked)`
-
-	rows, err := s.NamedExecContext(ctx, query, &order)
+	WITH input AS (
+		SELECT unnest($2::text[]) AS number
+	), inserted AS (
+		INSERT INTO orders(user_id,number,status,uploaded_at,checked)
+		SELECT $1, number, 'NEW', NOW(), false
+		FROM input
+		ON CONFLICT (number) DO NOTHING
+		RETURNING number
+	)
+	SELECT
+	    i.number,
+	    CASE
+	        WHEN ins.number IS NOT NULL THEN 'accepted'
+	        WHEN o.user_id=$1 THEN 'already_uploaded'
+	        ELSE 'uploaded_by_another_user'
+	    END AS result
+	FROM input i
+	LEFT JOIN inserted ins ON ins.number=i.number
+	LEFT JOIN orders o ON o.number=i.number`
+
+	var uploads []OrderUpload
+	err := s.SelectContext(ctx, &uploads, query, id, "{"+strings.Join(numbers, ",")+"}")
 	if err != nil {
-		return fmt.Errorf("s.NamedExecContext: %w", err)
-	}
-
-	if _, err = rows.RowsAffected(); err != nil {
-		return fmt.Errorf("rows.RowsAffected: %w", err)
+		return nil, fmt.Errorf("s.SelectContext: %w", err)
 	}
 
-	return nil
+	return uploads, nil
 }
 
 func (s Store) Orders(ctx context.Context, id uuid.UUID) ([]Order, error) {
@@ -261,110 +422,113 @@ func (s Store) Order(ctx context.Context, id uuid.UUID, number string) (Order, e
 	return orders[0], nil
 }
 
+// Balance returns oops.ErrAccountNotFound when the user has no balance row,
+// a zero balance is a valid account.
 func (s Store) Balance(ctx context.Context, id uuid.UUID) (Balance, error) {
 	query := `
 	SELECT
+	    user_id,
 	    current,
-	    withdrawn
+	    pending,
+	    held,
+	    withdrawn,
+	    debt
 	FROM balances
 	WHERE user_id=$1`
 
-	rows, err := s.QueryContext(ctx, query, id)
+	var balance Balance
+	err := s.GetContext(ctx, &balance, query, id)
 	if err != nil {
-		return Balance{}, fmt.Errorf("s.QueryContext: %w", err)
+		if errors.Is(err, sql.ErrNoRows) {
+			return Balance{}, oops.ErrAccountNotFound
+		}
+		return Balance{}, fmt.Errorf("s.GetContext: %w", err)
 	}
 
-	err = rows.Err()
-	if err != nil {
-		return Balance{}, fmt.Errorf("rows.Err: %w", err)
-	}
+	return balance, nil
+}
 
-	var balance Balance
-	for rows.Next() {
-		err = rows.Scan(&balance.Current, &balance.Withdrawn)
-		if err != nil {
-			return Balance{}, fmt.Errorf("rows.Next: %w", err)
-		}
+// Withdraw locks the balance row, so concurrent withdrawals of one user
+// cannot spend the same points twice. An order with an authorized hold is
+// paid by capturing the hold and fails with oops.ErrHoldExists.
+func (s Store) Withdraw(ctx context.Context, req Withdrawals, notify Notify[Withdrawals]) (Balance, error) {
+	tx, err := s.BeginTxx(ctx, nil)
+	if err != nil {
+		return Balance{}, fmt.Errorf("s.BeginTxx: %w", err)
 	}
 	defer func() {
-		err = rows.Close()
+		_ = tx.Rollback()
 	}()
 
-	return balance, nil
-}
-
-func (s Store) Withdraw(ctx context.Context, req Order, sum float32) error {
-	txBalance, err := s.BeginTx(ctx, nil)
+	balance, err := lockBalance(ctx, tx, req.UserID)
 	if err != nil {
-		return fmt.Errorf("s.Begin: %w", err)
+		return Balance{}, fmt.Errorf("lockBalance: %w", err)
+	}
+
+	if balance.Current < req.Sum {
+		return Balance{}, oops.ErrInsufficientFunds
 	}
 
-	txWithdraw, err := s.BeginTx(ctx, nil)
+	if err = lockNumber(ctx, tx, req.Number); err != nil {
+		return Balance{}, fmt.Errorf("lockNumber: %w", err)
+	}
+
+	queryHeld := `
+	SELECT
+	    count(*)
+	FROM holds
+	WHERE number=$1 AND status=$2`
+
+	var held int
+	err = tx.GetContext(ctx, &held, queryHeld, req.Number, HoldStatusAuthorized)
 	if err != nil {
-		return fmt.Errorf("s.Begin: %w", err)
+		return Balance{}, fmt.Errorf("tx.GetContext: %w", err)
+	}
+
+	if held > 0 {
+		return Balance{}, oops.ErrHoldExists
+	}
+
+	if err = checkMerchant(ctx, tx, req.MerchantID); err != nil {
+		return Balance{}, fmt.Errorf("checkMerchant: %w", err)
 	}
 
 	queryBalanceUpdate := `
 	UPDATE balances
 	SET
-	   current=$1,
-	   withdrawn=withdrawn+$2
-	WHERE user_id=$3`
-	resBalanceUpdate, err := txBalance.Exec(queryBalanceUpdate, *req.Accrual, sum, req.UserID)
+	   current=current-$1,
+	   withdrawn=withdrawn+$1
+	WHERE user_id=$2`
+	_, err = tx.ExecContext(ctx, queryBalanceUpdate, req.Sum, req.UserID)
 	if err != nil {
-		err = txBalance.Rollback()
-		if err != nil {
-			return fmt.Errorf("tx.Rollback: %w", err)
-		}
-		return fmt.Errorf("tx.QueryContext: %w", err)
+		return Balance{}, fmt.Errorf("tx.ExecContext: %w", constraintError(err))
 	}
-	_, err = resBalanceUpdate.RowsAffected()
-	if err != nil {
-		err = txBalance.Rollback()
-		if err != nil {
-			return fmt.Errorf("tx.Rollback: %w", err)
-		}
-		return fmt.Errorf("resBalanceUpdate.RowsAffected: %w", err)
+
+	if _, err = consumeLots(ctx, tx, req.UserID, req.Sum); err != nil {
+		return Balance{}, fmt.Errorf("consumeLots: %w", err)
 	}
 
 	queryWithdrawUpdate := `
-	INSERT INTO withdrawns (user_id, number, sum, processed_at)
-	VALUES ($1, $2, $3, NOW())
-	`
-	resWithdrawUpdate, err := txWithdraw.Exec(queryWithdrawUpdate, req.UserID, req.Number, sum)
+	INSERT INTO withdrawns (user_id, number, sum, merchant_id, processed_at)
+	VALUES ($1, $2, $3, $4, NOW())
+	RETURNING processed_at`
+	err = tx.GetContext(ctx, &req.ProcessedAt, queryWithdrawUpdate, req.UserID, req.Number, req.Sum, req.MerchantID)
 	if err != nil {
-		err = txWithdraw.Rollback()
-		if err != nil {
-			return fmt.Errorf("tx.Rollback: %w", err)
-		}
-		return fmt.Errorf("tx.QueryContext: %w", err)
-	}
-	_, err = resWithdrawUpdate.RowsAffected()
-	if err != nil {
-		err = txWithdraw.Rollback()
-		if err != nil {
-			return fmt.Errorf("tx.Rollback: %w", err)
-		}
-		return fmt.Errorf("resWithdrawUpdate.RowsAffected: %w", err)
+		return Balance{}, fmt.Errorf("tx.GetContext: %w", constraintError(err))
 	}
-	err = txBalance.Commit()
-	if err != nil {
-		err = txBalance.Rollback()
-		if err != nil {
-			return fmt.Errorf("tx.Rollback: %w", err)
-		}
-		return fmt.Errorf("tx.Commit: %w", err)
+
+	if err = enqueueWebhooks(ctx, tx, notify, req); err != nil {
+		return Balance{}, fmt.Errorf("enqueueWebhooks: %w", err)
 	}
-	err = txWithdraw.Commit()
-	if err != nil {
-		err = txWithdraw.Rollback()
-		if err != nil {
-			return fmt.Errorf("tx.Rollback: %w", err)
-		}
-		return fmt.Errorf("tx.Commit: %w", err)
+
+	if err = tx.Commit(); err != nil {
+		return Balance{}, fmt.Errorf("tx.Commit: %w", err)
 	}
 
-	return nil
+	balance.Current -= req.Sum
+	balance.Withdrawn += req.Sum
+
+	return balance, nil
 }
 
 func (s Store) Withdrawals(ctx context.Context, id uuid.UUID) ([]Withdrawals, error) {
@@ -372,6 +536,8 @@ func (s Store) Withdrawals(ctx context.Context, id uuid.UUID) ([]Withdrawals, er
 	SELECT
 	    number,
 	    sum,
+	    status,
+	    reversed,
 	    processed_at
 	FROM withdrawns
 	WHERE user_id=$1`
@@ -388,3 +554,31 @@ func (s Store) Withdrawals(ctx context.Context, id uuid.UUID) ([]Withdrawals, er
 
 	return withdrawals, nil
 }
+
+func (s Store) OrderEvents(ctx context.Context, id uuid.UUID, number string) ([]OrderEvent, error) {
+	query := `
+	SELECT
+	    id,
+	    user_id,
+	    number,
+	    previous_status,
+	    status,
+	    accrual,
+	    payload::text AS payload,
+	    created_at
+	FROM order_events
+	WHERE user_id=$1 AND number=$2
+	ORDER BY created_at, id`
+
+	var events []OrderEvent
+	err := s.SelectContext(ctx, &events, query, id, number)
+	if err != nil {
+		return nil, fmt.Errorf("s.SelectContext: %w", err)
+	}
+
+	if events == nil {
+		return nil, oops.ErrEmptyData
+	}
+
+	return events, nil
+}
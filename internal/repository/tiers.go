@@ -0,0 +1,106 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/google/uuid"
+)
+
+// Accrued is what the accrual system reported for the orders of the user
+// credited since a point in time, clawed back orders do not count. Tier
+// multipliers and bonuses are left out, or a tier would feed itself.
+type Accrued struct {
+	UserID  uuid.UUID `db:"user_id"`
+	Login   string    `db:"login"`
+	Role    string    `db:"role"`
+	Tier    string    `db:"tier"`
+	Accrued float32   `db:"accrued"`
+}
+
+const queryAccrued = `
+	SELECT
+	    u.id AS user_id,
+	    u.login,
+	    u.role,
+	    u.tier,
+	    COALESCE(sum(o.reported_accrual), 0) AS accrued
+	FROM users u
+	LEFT JOIN point_lots l ON l.user_id=u.id AND l.source='accrual' AND l.earned_at>=$1
+	LEFT JOIN orders o ON o.number=l.number AND o.status<>'CANCELLED'`
+
+func (s Store) UserTier(ctx context.Context, id uuid.UUID) (string, error) {
+	query := `
+	SELECT
+	    tier
+	FROM users
+	WHERE id=$1`
+
+	var tier string
+	err := s.GetContext(ctx, &tier, query, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", oops.ErrUserNotFound
+		}
+		return "", fmt.Errorf("s.GetContext: %w", err)
+	}
+
+	return tier, nil
+}
+
+func (s Store) UserAccrued(ctx context.Context, id uuid.UUID, since time.Time) (Accrued, error) {
+	query := queryAccrued + `
+	WHERE u.id=$2
+	GROUP BY u.id`
+
+	var accrued Accrued
+	err := s.GetContext(ctx, &accrued, query, since, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Accrued{}, oops.ErrUserNotFound
+		}
+		return Accrued{}, fmt.Errorf("s.GetContext: %w", err)
+	}
+
+	return accrued, nil
+}
+
+func (s Store) AccruedTotals(ctx context.Context, since time.Time) ([]Accrued, error) {
+	query := queryAccrued + `
+	GROUP BY u.id`
+
+	var totals []Accrued
+	err := s.SelectContext(ctx, &totals, query, since)
+	if err != nil {
+		return nil, fmt.Errorf("s.SelectContext: %w", err)
+	}
+
+	return totals, nil
+}
+
+func (s Store) SetTier(ctx context.Context, id uuid.UUID, tier string) error {
+	query := `
+	UPDATE users
+	SET tier=$1,tier_updated_at=NOW()
+	WHERE id=$2`
+
+	res, err := s.ExecContext(ctx, query, tier, id)
+	if err != nil {
+		return fmt.Errorf("s.ExecContext: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("res.RowsAffected(): %w", err)
+	}
+
+	if n == 0 {
+		return oops.ErrUserNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,202 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/google/uuid"
+)
+
+const LotSourceTransfer = "transfer"
+
+type Transfer struct {
+	ID             uuid.UUID `db:"id"`
+	FromUserID     uuid.UUID `db:"from_user_id"`
+	ToUserID       uuid.UUID `db:"to_user_id"`
+	FromLogin      string    `db:"from_login"`
+	ToLogin        string    `db:"to_login"`
+	Sum            float32   `db:"sum"`
+	Comment        string    `db:"comment"`
+	IdempotencyKey string    `db:"idempotency_key"`
+	CreatedAt      time.Time `db:"created_at"`
+}
+
+// Transfer moves points from one user to another in one transaction. Both
+// balances are locked in the order of their ids, so two users sending to each
+// other at once cannot deadlock. dailyLimit caps what the sender moves per
+// calendar day, zero means no limit. It returns the sender balance first.
+func (s Store) Transfer(
+	ctx context.Context,
+	t Transfer,
+	dailyLimit float32,
+	notify Notify[Transfer],
+) (Balance, Balance, error) {
+	tx, err := s.BeginTxx(ctx, nil)
+	if err != nil {
+		return Balance{}, Balance{}, fmt.Errorf("s.BeginTxx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	first, second := t.FromUserID, t.ToUserID
+	if second.String() < first.String() {
+		first, second = second, first
+	}
+
+	if _, err = lockBalance(ctx, tx, first); err != nil {
+		return Balance{}, Balance{}, fmt.Errorf("lockBalance: %w", err)
+	}
+	if _, err = lockBalance(ctx, tx, second); err != nil {
+		return Balance{}, Balance{}, fmt.Errorf("lockBalance: %w", err)
+	}
+
+	queryBalance := `
+	SELECT
+	    current
+	FROM balances
+	WHERE user_id=$1`
+
+	var current float32
+	err = tx.GetContext(ctx, &current, queryBalance, t.FromUserID)
+	if err != nil {
+		return Balance{}, Balance{}, fmt.Errorf("tx.GetContext: %w", err)
+	}
+
+	if current < t.Sum {
+		return Balance{}, Balance{}, oops.ErrInsufficientFunds
+	}
+
+	if dailyLimit > 0 {
+		querySent := `
+		SELECT
+		    COALESCE(sum(sum), 0)
+		FROM transfers
+		WHERE from_user_id=$1 AND created_at>=date_trunc('day', NOW())`
+
+		var sent float32
+		err = tx.GetContext(ctx, &sent, querySent, t.FromUserID)
+		if err != nil {
+			return Balance{}, Balance{}, fmt.Errorf("tx.GetContext: %w", err)
+		}
+
+		if cents(sent+t.Sum) > cents(dailyLimit) {
+			return Balance{}, Balance{}, oops.ErrTransferLimit
+		}
+	}
+
+	queryTransfer := `
+	INSERT INTO transfers(id,from_user_id,to_user_id,sum,comment,idempotency_key,created_at)
+	VALUES ($1,$2,$3,$4,$5,$6,NOW())
+	RETURNING created_at`
+
+	err = tx.GetContext(ctx, &t.CreatedAt, queryTransfer,
+		t.ID, t.FromUserID, t.ToUserID, t.Sum, t.Comment, t.IdempotencyKey)
+	if err != nil {
+		return Balance{}, Balance{}, fmt.Errorf("tx.GetContext: %w", constraintError(err))
+	}
+
+	takes, err := consumeLots(ctx, tx, t.FromUserID, t.Sum)
+	if err != nil {
+		return Balance{}, Balance{}, fmt.Errorf("consumeLots: %w", err)
+	}
+
+	var taken float32
+	for _, v := range takes {
+		taken += v.Amount
+	}
+
+	// The lots are copied to the recipient, lots holding less than the
+	// balance would leave the recipient's lots short as well.
+	if cents(taken) < cents(t.Sum) {
+		return Balance{}, Balance{}, fmt.Errorf("%w: the lots hold %.2f, the transfer %.2f",
+			oops.ErrBalanceDrift, taken, t.Sum)
+	}
+
+	queryDebit := `
+	UPDATE balances
+	SET current=current-$1
+	WHERE user_id=$2
+	RETURNING user_id, current, pending, held, withdrawn, debt`
+
+	var from Balance
+	err = tx.GetContext(ctx, &from, queryDebit, t.Sum, t.FromUserID)
+	if err != nil {
+		return Balance{}, Balance{}, fmt.Errorf("tx.GetContext: %w", constraintError(err))
+	}
+
+	queryCredit := `
+	UPDATE balances
+	SET current=current+$1
+	WHERE user_id=$2`
+
+	_, err = tx.ExecContext(ctx, queryCredit, t.Sum, t.ToUserID)
+	if err != nil {
+		return Balance{}, Balance{}, fmt.Errorf("tx.ExecContext: %w", err)
+	}
+
+	// The recipient gets a lot per lot of the sender, each expiring when the
+	// points did for the sender, so a transfer cannot extend their life.
+	number := t.ID.String()
+	for _, v := range takes {
+		err = addLot(ctx, tx, PointLot{
+			UserID:    t.ToUserID,
+			Source:    LotSourceTransfer,
+			Number:    &number,
+			Amount:    v.Amount,
+			ExpiresAt: v.ExpiresAt,
+		})
+		if err != nil {
+			return Balance{}, Balance{}, fmt.Errorf("addLot: %w", err)
+		}
+	}
+
+	to, err := settleDebt(ctx, tx, t.ToUserID)
+	if err != nil {
+		return Balance{}, Balance{}, fmt.Errorf("settleDebt: %w", err)
+	}
+
+	if err = enqueueWebhooks(ctx, tx, notify, t); err != nil {
+		return Balance{}, Balance{}, fmt.Errorf("enqueueWebhooks: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Balance{}, Balance{}, fmt.Errorf("tx.Commit: %w", err)
+	}
+
+	return from, to, nil
+}
+
+// Transfers returns the transfers sent and received by the user, newest first.
+func (s Store) Transfers(ctx context.Context, id uuid.UUID) ([]Transfer, error) {
+	query := `
+	SELECT
+	    t.id,
+	    t.from_user_id,
+	    t.to_user_id,
+	    f.login AS from_login,
+	    r.login AS to_login,
+	    t.sum,
+	    t.comment,
+	    t.idempotency_key,
+	    t.created_at
+	FROM transfers t
+	JOIN users f ON f.id=t.from_user_id
+	JOIN users r ON r.id=t.to_user_id
+	WHERE t.from_user_id=$1 OR t.to_user_id=$1
+	ORDER BY t.created_at DESC`
+
+	var transfers []Transfer
+	err := s.SelectContext(ctx, &transfers, query, id)
+	if err != nil {
+		return nil, fmt.Errorf("s.SelectContext: %w", err)
+	}
+
+	if transfers == nil {
+		return nil, oops.ErrEmptyData
+	}
+
+	return transfers, nil
+}
@@ -0,0 +1,97 @@
+package repository
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TextArray is a Postgres text[] exchanged as an array literal, the pgx stdlib
+// driver does not encode or decode Go slices.
+type TextArray []string
+
+func (a TextArray) Value() (driver.Value, error) {
+	if a == nil {
+		return "{}", nil
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, v := range a {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteByte('"')
+		b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+
+	return b.String(), nil
+}
+
+func (a *TextArray) Scan(src any) error {
+	var s string
+	switch v := src.(type) {
+	case nil:
+		*a = nil
+		return nil
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("unsupported text array source %T", src)
+	}
+
+	if len(s) < 2 || s[0] != '{' || s[len(s)-1] != '}' {
+		return fmt.Errorf("invalid text array %q", s)
+	}
+	s = s[1 : len(s)-1]
+
+	result := TextArray{}
+	for len(s) > 0 {
+		var (
+			elem string
+			err  error
+		)
+		elem, s, err = scanArrayElem(s)
+		if err != nil {
+			return err
+		}
+		result = append(result, elem)
+	}
+	*a = result
+
+	return nil
+}
+
+func scanArrayElem(s string) (elem, rest string, err error) {
+	if s[0] != '"' {
+		i := strings.IndexByte(s, ',')
+		if i < 0 {
+			return s, "", nil
+		}
+		return s[:i], s[i+1:], nil
+	}
+
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+			if i < len(s) {
+				b.WriteByte(s[i])
+			}
+		case '"':
+			rest = s[i+1:]
+			rest = strings.TrimPrefix(rest, ",")
+			return b.String(), rest, nil
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+
+	return "", "", errors.New("unterminated quoted array element")
+}
@@ -0,0 +1,232 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	WebhookStatusPending   = "pending"
+	WebhookStatusDelivered = "delivered"
+	WebhookStatusDead      = "dead"
+)
+
+type WebhookDelivery struct {
+	ID            int64      `db:"id"`
+	WebhookID     uuid.UUID  `db:"webhook_id"`
+	URL           string     `db:"url"`
+	Secret        string     `db:"secret"`
+	EventType     string     `db:"event_type"`
+	Payload       []byte     `db:"payload"`
+	Status        string     `db:"status"`
+	Attempts      int        `db:"attempts"`
+	ResponseCode  *int       `db:"response_code"`
+	LastError     *string    `db:"last_error"`
+	NextAttemptAt time.Time  `db:"next_attempt_at"`
+	DeliveredAt   *time.Time `db:"delivered_at"`
+}
+
+// Webhook is a subscription of an endpoint to event types, Secret signs the
+// deliveries.
+type Webhook struct {
+	ID         uuid.UUID `db:"id"`
+	URL        string    `db:"url"`
+	Secret     string    `db:"secret"`
+	EventTypes TextArray `db:"event_types"`
+	Active     bool      `db:"active"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+// WebhookEvent is queued for every active subscription to its type.
+type WebhookEvent struct {
+	Type    string
+	Payload []byte
+}
+
+// Notify builds the webhook events of a change from its result. The store
+// calls it in the transaction of the change, so the events are queued exactly
+// when the change commits. A nil Notify queues nothing.
+type Notify[T any] func(T) ([]WebhookEvent, error)
+
+func enqueueWebhooks[T any](ctx context.Context, tx *sqlx.Tx, notify Notify[T], result T) error {
+	if notify == nil {
+		return nil
+	}
+
+	events, err := notify(result)
+	if err != nil {
+		return fmt.Errorf("notify: %w", err)
+	}
+
+	query := `
+	INSERT INTO webhook_deliveries(webhook_id,event_type,payload)
+	SELECT id, $1, $2::jsonb
+	FROM webhooks
+	WHERE active AND $1=ANY(event_types)`
+
+	for _, v := range events {
+		_, err = tx.ExecContext(ctx, query, v.Type, string(v.Payload))
+		if err != nil {
+			return fmt.Errorf("tx.ExecContext: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (s Store) CreateWebhook(ctx context.Context, w Webhook, audit Audit[Webhook]) (Webhook, error) {
+	tx, err := s.BeginTxx(ctx, nil)
+	if err != nil {
+		return Webhook{}, fmt.Errorf("s.BeginTxx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	query := `
+	INSERT INTO webhooks(id,url,secret,event_types,active,created_at)
+	VALUES ($1,$2,$3,$4,true,NOW())
+	RETURNING id, url, secret, event_types, active, created_at`
+
+	var webhook Webhook
+	err = tx.GetContext(ctx, &webhook, query, w.ID, w.URL, w.Secret, w.EventTypes)
+	if err != nil {
+		return Webhook{}, fmt.Errorf("tx.GetContext: %w", err)
+	}
+
+	if err = addAuditLog(ctx, tx, audit, webhook); err != nil {
+		return Webhook{}, fmt.Errorf("addAuditLog: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Webhook{}, fmt.Errorf("tx.Commit: %w", err)
+	}
+
+	return webhook, nil
+}
+
+func (s Store) Webhooks(ctx context.Context) ([]Webhook, error) {
+	query := `
+	SELECT
+	    id,
+	    url,
+	    secret,
+	    event_types,
+	    COALESCE(active, false) AS active,
+	    created_at
+	FROM webhooks
+	ORDER BY created_at DESC`
+
+	var webhooks []Webhook
+	err := s.SelectContext(ctx, &webhooks, query)
+	if err != nil {
+		return nil, fmt.Errorf("s.SelectContext: %w", err)
+	}
+
+	if webhooks == nil {
+		return nil, oops.ErrEmptyData
+	}
+
+	return webhooks, nil
+}
+
+// DeactivateWebhook stops new deliveries to the subscription, the queued ones
+// are still sent.
+func (s Store) DeactivateWebhook(ctx context.Context, id uuid.UUID, audit Audit[uuid.UUID]) error {
+	tx, err := s.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("s.BeginTxx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	query := `
+	UPDATE webhooks
+	SET active=false
+	WHERE id=$1`
+
+	res, err := tx.ExecContext(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("tx.ExecContext: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("res.RowsAffected(): %w", err)
+	}
+
+	if n == 0 {
+		return oops.ErrWebhookNotFound
+	}
+
+	if err = addAuditLog(ctx, tx, audit, id); err != nil {
+		return fmt.Errorf("addAuditLog: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit: %w", err)
+	}
+
+	return nil
+}
+
+// ClaimWebhookDeliveries leases due deliveries by pushing next_attempt_at
+// forward, so several instances never send the same delivery concurrently.
+func (s Store) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	query := `
+	UPDATE webhook_deliveries d
+	SET next_attempt_at=NOW()+make_interval(secs => $2)
+	FROM webhooks w
+	WHERE w.id=d.webhook_id AND d.id IN (
+		SELECT id
+		FROM webhook_deliveries
+		WHERE status='pending' AND next_attempt_at<=NOW()
+		ORDER BY next_attempt_at
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING
+	    d.id,
+	    d.webhook_id,
+	    w.url,
+	    w.secret,
+	    d.event_type,
+	    d.payload::text AS payload,
+	    d.status,
+	    d.attempts,
+	    d.next_attempt_at`
+
+	var deliveries []WebhookDelivery
+	err := s.SelectContext(ctx, &deliveries, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("s.SelectContext: %w", err)
+	}
+
+	return deliveries, nil
+}
+
+func (s Store) UpdateWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	query := `
+	UPDATE webhook_deliveries
+	SET status=$1,attempts=$2,response_code=$3,last_error=$4,next_attempt_at=$5,delivered_at=$6
+	WHERE id=$7`
+
+	res, err := s.ExecContext(ctx, query, delivery.Status, delivery.Attempts, delivery.ResponseCode,
+		delivery.LastError, delivery.NextAttemptAt, delivery.DeliveredAt, delivery.ID)
+	if err != nil {
+		return fmt.Errorf("s.ExecContext: %w", err)
+	}
+
+	_, err = res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("res.RowsAffected(): %w", err)
+	}
+
+	return nil
+}
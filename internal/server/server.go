@@ -2,15 +2,23 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/1Asi1/gophermart/internal/config"
+	"github.com/1Asi1/gophermart/internal/events"
 	"github.com/1Asi1/gophermart/internal/integration"
 	"github.com/1Asi1/gophermart/internal/integration/accrual"
+	"github.com/1Asi1/gophermart/internal/integration/notifier"
+	"github.com/1Asi1/gophermart/internal/integration/webhook"
+	"github.com/1Asi1/gophermart/internal/jobs"
+	"github.com/1Asi1/gophermart/internal/models"
 	"github.com/1Asi1/gophermart/internal/repository"
 	"github.com/1Asi1/gophermart/internal/service"
 	"github.com/1Asi1/gophermart/internal/transport/rest"
@@ -27,6 +35,14 @@ const (
 	WriteTimeoutServer = 10
 	IdleTimeoutServer  = 120
 	timeoutShutdown    = 5
+
+	repairBalancesInterval = time.Hour
+	expirePointsInterval   = time.Hour
+	releasePointsInterval  = 10 * time.Minute
+	expireHoldsInterval    = time.Minute
+	recomputeTiersAt       = 3 * time.Hour
+
+	purgeIdempotencyKeysInterval = time.Hour
 )
 
 type Server struct {
@@ -53,6 +69,7 @@ func (s *Server) Run() {
 		MaxConn:         maxConnDB,
 		MaxConnLifeTime: maxConnLifeTimeDB * time.Second,
 		MaxConnIdleTime: maxConnIdleTimeDB * time.Second,
+		AutoMigrate:     cfg.AutoMigrate,
 	})
 	if err != nil {
 		l.Fatal().Err(err).Msg("repository.New")
@@ -60,13 +77,94 @@ func (s *Server) Run() {
 
 	cl := accrual.New(cfg, l)
 
-	sv := service.New(st, cl)
+	hub := events.New()
+
+	wh := webhook.New(st, l)
+	go func() {
+		wh.Sync(context.Background())
+	}()
+
+	var nt notifier.Notifier = notifier.NewLog(l)
+	if cfg.NotifierFile != "" {
+		nt = notifier.NewFile(cfg.NotifierFile)
+	}
+
+	tiers, err := newTiers(cfg)
+	if err != nil {
+		l.Fatal().Err(err).Msg("newTiers")
+	}
+	tierWindow := time.Duration(cfg.TierWindowDays) * 24 * time.Hour
+
+	sv := service.New(st, cl, hub, nt, service.Config{
+		AdminTokens:        cfg.AdminTokens,
+		PointsExpiryMonths: cfg.PointsExpiryMonths,
+		ExpiringSoon:       time.Duration(cfg.PointsExpiringSoonDays) * 24 * time.Hour,
+		HoldTTL:            time.Duration(cfg.HoldTTLMinutes) * time.Minute,
+		TransferDailyLimit: float32(cfg.TransferDailyLimit),
+		Tiers:              tiers,
+		TierWindow:         tierWindow,
+	})
+
+	policy, err := newPolicy(cfg)
+	if err != nil {
+		l.Fatal().Err(err).Msg("newPolicy")
+	}
+
+	proxies, err := newProxies(cfg)
+	if err != nil {
+		l.Fatal().Err(err).Msg("newProxies")
+	}
 
-	mg := integration.New(&cl, st, l)
+	mg := integration.New(&cl, st, hub, integration.Config{
+		PointsExpiryMonths: cfg.PointsExpiryMonths,
+		HoldPeriod:         time.Duration(cfg.AccrualHoldDays) * 24 * time.Hour,
+		Tiers:              tiers,
+		ReferralBonus:      float32(cfg.ReferralBonus),
+		ReferralMaxRewards: cfg.ReferralMaxRewards,
+	}, l)
 	go func() {
 		mg.Sync(context.Background())
 	}()
 
+	jobs.Sync(context.Background(), l, jobs.Job{
+		Name:     "repair_balances",
+		Interval: repairBalancesInterval,
+		Run: func(ctx context.Context) error {
+			n, err := sv.RepairBalances(ctx)
+			if n > 0 {
+				l.Warn().Int64("count", n).Msg("missing balances repaired")
+			}
+			return err
+		},
+	}, jobs.Job{
+		Name:     "expire_points",
+		Interval: expirePointsInterval,
+		Run:      sv.ExpirePoints,
+	}, jobs.Job{
+		Name:     "release_points",
+		Interval: releasePointsInterval,
+		Run:      sv.ReleasePoints,
+	}, jobs.Job{
+		Name:     "expire_holds",
+		Interval: expireHoldsInterval,
+		Run:      sv.ExpireHolds,
+	}, jobs.Job{
+		Name:     "recompute_tiers",
+		Interval: 24 * time.Hour,
+		At:       recomputeTiersAt,
+		Run:      sv.RecomputeTiers,
+	}, jobs.Job{
+		Name:     "purge_idempotency_keys",
+		Interval: purgeIdempotencyKeysInterval,
+		Run: func(ctx context.Context) error {
+			n, err := sv.PurgeIdempotencyKeys(ctx)
+			if n > 0 {
+				l.Info().Int64("count", n).Msg("idempotency keys purged")
+			}
+			return err
+		},
+	})
+
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
 
@@ -74,7 +172,7 @@ func (s *Server) Run() {
 
 	httpServer := &http.Server{
 		Addr:         cfg.ServerAddr,
-		Handler:      rest.New(sv, l),
+		Handler:      rest.New(sv, policy, proxies, l),
 		ReadTimeout:  ReadTimeoutServer * time.Second,
 		WriteTimeout: WriteTimeoutServer * time.Second,
 		IdleTimeout:  IdleTimeoutServer * time.Second,
@@ -99,3 +197,58 @@ func (s *Server) Run() {
 		l.Err(err).Msg(err.Error())
 	}
 }
+
+func newPolicy(cfg config.Config) (models.Policy, error) {
+	var denylist []string
+	if cfg.PasswordDenylistFile != "" {
+		data, err := os.ReadFile(cfg.PasswordDenylistFile)
+		if err != nil {
+			return models.Policy{}, fmt.Errorf("os.ReadFile: %w", err)
+		}
+		denylist = strings.Split(string(data), "\n")
+	}
+
+	return models.NewPolicy(cfg.LoginMinLen, cfg.LoginMaxLen, cfg.PasswordMinLen, denylist), nil
+}
+
+func newTiers(cfg config.Config) (models.Tiers, error) {
+	value := cfg.Tiers
+	if value == "" {
+		value = models.DefaultTiers
+	}
+
+	tiers, err := models.ParseTiers(value)
+	if err != nil {
+		return nil, fmt.Errorf("models.ParseTiers: %w", err)
+	}
+
+	return tiers, nil
+}
+
+// newProxies parses the trusted proxies, a bare address stands for itself.
+func newProxies(cfg config.Config) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, v := range strings.Split(cfg.TrustedProxies, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		if strings.Contains(v, "/") {
+			prefix, err := netip.ParsePrefix(v)
+			if err != nil {
+				return nil, fmt.Errorf("netip.ParsePrefix: %w", err)
+			}
+			proxies = append(proxies, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return nil, fmt.Errorf("netip.ParseAddr: %w", err)
+		}
+		proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+
+	return proxies, nil
+}
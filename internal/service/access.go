@@ -0,0 +1,123 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/1Asi1/gophermart/internal/models"
+	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/1Asi1/gophermart/internal/repository"
+	"github.com/google/uuid"
+	"golang.org/x/net/context"
+)
+
+const (
+	auditSetRole      = "access.set_role"
+	auditCreateAPIKey = "access.create_api_key"
+	auditRevokeAPIKey = "access.revoke_api_key"
+
+	apiKeyPrefix = "apikey:"
+	apiKeySize   = 32
+)
+
+// CheckAccess resolves the token of an operator, a user or a service account.
+func (s *Service) CheckAccess(ctx context.Context, token string) (models.Principal, error) {
+	if token == "" {
+		return models.Principal{}, oops.ErrInvalidToken
+	}
+
+	for name, v := range s.cfg.AdminTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(v)) == 1 {
+			return models.Principal{
+				Name:        name,
+				Role:        models.RoleAdmin,
+				Permissions: models.RolePermissions[models.RoleAdmin],
+			}, nil
+		}
+	}
+
+	user, err := s.store.CheckToken(ctx, token)
+	if err == nil {
+		return models.Principal{
+			ID:          user.ID,
+			Name:        user.Login,
+			Role:        user.Role,
+			Permissions: append(append([]string{}, models.RolePermissions[user.Role]...), user.Permissions...),
+		}, nil
+	}
+	if !errors.Is(err, oops.ErrInvalidToken) {
+		return models.Principal{}, fmt.Errorf("s.store.CheckToken: %w", err)
+	}
+
+	key, err := s.store.CheckAPIKey(ctx, hashAPIKey(token))
+	if err != nil {
+		return models.Principal{}, fmt.Errorf("s.store.CheckAPIKey: %w", err)
+	}
+
+	return models.Principal{
+		ID:          key.ID,
+		Name:        apiKeyPrefix + key.Name,
+		Permissions: models.ServicePermissions(key.Permissions),
+	}, nil
+}
+
+func (s *Service) SetRole(ctx context.Context, operator string, id uuid.UUID, req models.RoleRequest) error {
+	err := s.store.SetRole(ctx, id, req.Role, req.Permissions,
+		audit[uuid.UUID](operator, auditSetRole, &id, req))
+	if err != nil {
+		return fmt.Errorf("s.store.SetRole: %w", err)
+	}
+
+	return nil
+}
+
+// CreateAPIKey issues a service account key, only its hash is stored so the
+// key is returned once.
+func (s *Service) CreateAPIKey(ctx context.Context, operator string, req models.APIKeyRequest) (models.APIKey, error) {
+	buf := make([]byte, apiKeySize)
+	if _, err := rand.Read(buf); err != nil {
+		return models.APIKey{}, fmt.Errorf("rand.Read: %w", err)
+	}
+	key := hex.EncodeToString(buf)
+
+	model := repository.APIKey{
+		ID:          uuid.New(),
+		Name:        req.Name,
+		KeyHash:     hashAPIKey(key),
+		Permissions: req.Permissions,
+		CreatedBy:   operator,
+	}
+	err := s.store.CreateAPIKey(ctx, model, audit[repository.APIKey](operator, auditCreateAPIKey, nil, map[string]any{
+		"id":          model.ID,
+		"name":        req.Name,
+		"permissions": req.Permissions,
+	}))
+	if err != nil {
+		return models.APIKey{}, fmt.Errorf("s.store.CreateAPIKey: %w", err)
+	}
+
+	return models.APIKey{
+		ID:          model.ID,
+		Name:        req.Name,
+		Key:         key,
+		Permissions: req.Permissions,
+	}, nil
+}
+
+func (s *Service) RevokeAPIKey(ctx context.Context, operator string, id uuid.UUID) error {
+	err := s.store.RevokeAPIKey(ctx, id, audit[uuid.UUID](operator, auditRevokeAPIKey, nil, map[string]any{"id": id}))
+	if err != nil {
+		return fmt.Errorf("s.store.RevokeAPIKey: %w", err)
+	}
+
+	return nil
+}
+
+func hashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
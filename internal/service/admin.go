@@ -0,0 +1,285 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/1Asi1/gophermart/internal/events"
+	"github.com/1Asi1/gophermart/internal/integration/webhook"
+	"github.com/1Asi1/gophermart/internal/models"
+	"github.com/1Asi1/gophermart/internal/repository"
+	"github.com/google/uuid"
+	"golang.org/x/net/context"
+)
+
+const (
+	auditBlock    = "user.block"
+	auditUnblock  = "user.unblock"
+	auditAdjust   = "balance.adjust"
+	auditRequeue  = "order.requeue"
+	auditReverse  = "withdrawal.reverse"
+	auditClawback = "order.clawback"
+
+	auditSearchUsers     = "user.search"
+	auditViewOrders      = "user.orders.view"
+	auditViewOrderEvents = "user.order_events.view"
+	auditViewBalance     = "user.balance.view"
+	auditViewWithdrawals = "user.withdrawals.view"
+)
+
+// SearchUsers is audited like the other operator reads, the entry is written
+// before the data is returned.
+func (s *Service) SearchUsers(ctx context.Context, operator, login string) ([]models.AdminUser, error) {
+	err := s.auditRead(ctx, operator, auditSearchUsers, nil, map[string]string{"login": login})
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := s.store.SearchUsers(ctx, login)
+	if err != nil {
+		return nil, fmt.Errorf(":%w", err)
+	}
+
+	result := make([]models.AdminUser, len(users))
+	for i, v := range users {
+		result[i] = models.AdminUser{
+			ID:      v.ID,
+			Login:   v.Login,
+			Blocked: v.Blocked,
+		}
+	}
+
+	return result, nil
+}
+
+// AdminOrders returns the orders of any user to an operator.
+func (s *Service) AdminOrders(ctx context.Context, operator string, id uuid.UUID) ([]models.Order, error) {
+	if err := s.auditRead(ctx, operator, auditViewOrders, &id, nil); err != nil {
+		return nil, err
+	}
+
+	return s.Orders(ctx, id)
+}
+
+// AdminOrderEvents returns the history of an order of any user to an operator.
+func (s *Service) AdminOrderEvents(
+	ctx context.Context,
+	operator string,
+	id uuid.UUID,
+	number string,
+) ([]models.OrderEvent, error) {
+	err := s.auditRead(ctx, operator, auditViewOrderEvents, &id, map[string]string{"number": number})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.OrderEvents(ctx, id, number)
+}
+
+// AdminBalance returns the balance of any user to an operator.
+func (s *Service) AdminBalance(ctx context.Context, operator string, id uuid.UUID) (models.Balance, error) {
+	if err := s.auditRead(ctx, operator, auditViewBalance, &id, nil); err != nil {
+		return models.Balance{}, err
+	}
+
+	return s.Balance(ctx, id)
+}
+
+// AdminWithdrawals returns the withdrawals of any user to an operator.
+func (s *Service) AdminWithdrawals(ctx context.Context, operator string, id uuid.UUID) ([]models.Withdraw, error) {
+	if err := s.auditRead(ctx, operator, auditViewWithdrawals, &id, nil); err != nil {
+		return nil, err
+	}
+
+	return s.Withdrawals(ctx, id)
+}
+
+func (s *Service) SetBlocked(ctx context.Context, operator string, id uuid.UUID, blocked bool) error {
+	action := auditUnblock
+	if blocked {
+		action = auditBlock
+	}
+
+	if err := s.store.SetBlocked(ctx, id, blocked, audit[uuid.UUID](operator, action, &id, nil)); err != nil {
+		return fmt.Errorf("s.store.SetBlocked: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Service) RequeueOrder(ctx context.Context, operator, number string) error {
+	_, err := s.store.RequeueOrder(ctx, number, func(o repository.Order) (repository.AuditLog, error) {
+		return newAuditLog(operator, auditRequeue, &o.UserID, map[string]string{"number": number})
+	})
+	if err != nil {
+		return fmt.Errorf("s.store.RequeueOrder: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Service) AdjustBalance(
+	ctx context.Context,
+	operator string,
+	id uuid.UUID,
+	req models.AdjustmentRequest,
+) (models.Balance, error) {
+	balance, err := s.store.AdjustBalance(ctx, repository.Adjustment{
+		UserID:    id,
+		Amount:    req.Amount,
+		Reason:    req.Reason,
+		Operator:  operator,
+		ExpiresAt: models.PointsExpiry(time.Now(), s.cfg.PointsExpiryMonths),
+	}, audit[repository.Balance](operator, auditAdjust, &id, req))
+	if err != nil {
+		return models.Balance{}, fmt.Errorf("s.store.AdjustBalance: %w", err)
+	}
+
+	result := models.Balance{
+		Current:   balance.Current,
+		Pending:   balance.Pending,
+		Held:      balance.Held,
+		Withdrawn: balance.Withdrawn,
+		Debt:      balance.Debt,
+	}
+
+	s.hub.Publish(id, events.TypeBalance, result)
+
+	return result, nil
+}
+
+// ReverseWithdrawal refunds a withdrawal fully or partly, operator is the
+// admin or the merchant account asking for it. A merchant only refunds the
+// withdrawals made at it, merchant is nil for an admin.
+func (s *Service) ReverseWithdrawal(
+	ctx context.Context,
+	operator string,
+	merchant *uuid.UUID,
+	number string,
+	req models.ReversalRequest,
+) (models.Withdraw, error) {
+	withdrawal, balance, err := s.store.ReverseWithdrawal(ctx, repository.Reversal{
+		Number:     number,
+		Amount:     req.Sum,
+		Reason:     req.Reason,
+		Operator:   operator,
+		MerchantID: merchant,
+		ExpiresAt:  models.PointsExpiry(time.Now(), s.cfg.PointsExpiryMonths),
+	}, func(w repository.Withdrawals) ([]repository.WebhookEvent, error) {
+		return webhook.NewEvents(webhook.EventWithdrawalReversed, w.UserID, withdrawModel(w))
+	}, func(r repository.Reversed) (repository.AuditLog, error) {
+		return newAuditLog(operator, auditReverse, &r.Withdrawal.UserID, map[string]any{
+			"number": number,
+			"sum":    r.Amount,
+			"reason": req.Reason,
+		})
+	})
+	if err != nil {
+		return models.Withdraw{}, fmt.Errorf("s.store.ReverseWithdrawal: %w", err)
+	}
+
+	result := withdrawModel(withdrawal)
+
+	s.hub.Publish(withdrawal.UserID, events.TypeBalance, models.Balance{
+		Current:   balance.Current,
+		Pending:   balance.Pending,
+		Held:      balance.Held,
+		Withdrawn: balance.Withdrawn,
+		Debt:      balance.Debt,
+	})
+
+	return result, nil
+}
+
+// ClawbackOrder cancels the order and takes back its accrual, the reason and
+// the operator are kept in the order history.
+func (s *Service) ClawbackOrder(
+	ctx context.Context,
+	operator string,
+	number string,
+	req models.ClawbackRequest,
+) (models.Balance, error) {
+	payload, err := json.Marshal(map[string]string{"operator": operator, "reason": req.Reason})
+	if err != nil {
+		return models.Balance{}, fmt.Errorf("json.Marshal: %w", err)
+	}
+
+	order, balance, amount, err := s.store.ClawbackOrder(ctx, repository.Clawback{
+		Number:  number,
+		Payload: payload,
+	}, webhook.ClawbackEvents, func(c repository.Clawed) (repository.AuditLog, error) {
+		return newAuditLog(operator, auditClawback, &c.Order.UserID, map[string]any{
+			"number": number,
+			"amount": c.Amount,
+			"reason": req.Reason,
+		})
+	})
+	if err != nil {
+		return models.Balance{}, fmt.Errorf("s.store.ClawbackOrder: %w", err)
+	}
+
+	result := models.Balance{
+		Current:   balance.Current,
+		Pending:   balance.Pending,
+		Held:      balance.Held,
+		Withdrawn: balance.Withdrawn,
+		Debt:      balance.Debt,
+	}
+
+	status := models.Order{
+		Number:     order.Number,
+		Status:     repository.OrderStatusCancelled,
+		Accrual:    order.Accrual,
+		UploadedAt: order.UploadedAt,
+	}
+	s.hub.Publish(order.UserID, events.TypeOrder, status)
+
+	if amount > 0 {
+		s.hub.Publish(order.UserID, events.TypeBalance, result)
+	}
+
+	return result, nil
+}
+
+// audit records an operator change in the transaction of the change, the change
+// fails when its entry cannot be written. The entry does not depend on the
+// result of the change.
+func audit[T any](operator, action string, id *uuid.UUID, details any) repository.Audit[T] {
+	return func(T) (repository.AuditLog, error) {
+		return newAuditLog(operator, action, id, details)
+	}
+}
+
+func newAuditLog(operator, action string, id *uuid.UUID, details any) (repository.AuditLog, error) {
+	entry := repository.AuditLog{
+		Operator: operator,
+		Action:   action,
+		UserID:   id,
+	}
+
+	if details != nil {
+		data, err := json.Marshal(details)
+		if err != nil {
+			return repository.AuditLog{}, fmt.Errorf("json.Marshal: %w", err)
+		}
+		entry.Details = data
+	}
+
+	return entry, nil
+}
+
+// auditRead records an operator read, the data is not returned when its entry
+// cannot be written.
+func (s *Service) auditRead(ctx context.Context, operator, action string, id *uuid.UUID, details any) error {
+	entry, err := newAuditLog(operator, action, id, details)
+	if err != nil {
+		return err
+	}
+
+	if err = s.store.CreateAuditLog(ctx, entry); err != nil {
+		return fmt.Errorf("s.store.CreateAuditLog: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/1Asi1/gophermart/internal/models"
+	"github.com/1Asi1/gophermart/internal/repository"
+)
+
+const (
+	auditCampaignCreate     = "campaign.create"
+	auditCampaignUpdate     = "campaign.update"
+	auditCampaignDeactivate = "campaign.deactivate"
+)
+
+func (s *Service) Campaigns(ctx context.Context) ([]models.Campaign, error) {
+	campaigns, err := s.store.Campaigns(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("s.store.Campaigns: %w", err)
+	}
+
+	result := make([]models.Campaign, len(campaigns))
+	for i, v := range campaigns {
+		result[i] = campaignModel(v)
+	}
+
+	return result, nil
+}
+
+func (s *Service) CreateCampaign(
+	ctx context.Context,
+	operator string,
+	req models.CampaignRequest,
+) (models.Campaign, error) {
+	campaign := campaignFromRequest(req)
+	campaign.CreatedBy = operator
+
+	campaign, err := s.store.CreateCampaign(ctx, campaign,
+		func(c repository.Campaign) (repository.AuditLog, error) {
+			return newAuditLog(operator, auditCampaignCreate, nil, map[string]any{"id": c.ID, "campaign": req})
+		})
+	if err != nil {
+		return models.Campaign{}, fmt.Errorf("s.store.CreateCampaign: %w", err)
+	}
+
+	return campaignModel(campaign), nil
+}
+
+func (s *Service) UpdateCampaign(
+	ctx context.Context,
+	operator string,
+	id int64,
+	req models.CampaignRequest,
+) (models.Campaign, error) {
+	campaign := campaignFromRequest(req)
+	campaign.ID = id
+
+	campaign, err := s.store.UpdateCampaign(ctx, campaign,
+		audit[repository.Campaign](operator, auditCampaignUpdate, nil, map[string]any{"id": id, "campaign": req}))
+	if err != nil {
+		return models.Campaign{}, fmt.Errorf("s.store.UpdateCampaign: %w", err)
+	}
+
+	return campaignModel(campaign), nil
+}
+
+func (s *Service) DeactivateCampaign(ctx context.Context, operator string, id int64) error {
+	err := s.store.DeactivateCampaign(ctx, id,
+		audit[int64](operator, auditCampaignDeactivate, nil, map[string]int64{"id": id}))
+	if err != nil {
+		return fmt.Errorf("s.store.DeactivateCampaign: %w", err)
+	}
+
+	return nil
+}
+
+// campaignFromRequest makes a campaign active unless the request says otherwise.
+func campaignFromRequest(req models.CampaignRequest) repository.Campaign {
+	active := true
+	if req.Active != nil {
+		active = *req.Active
+	}
+
+	return repository.Campaign{
+		Name:       req.Name,
+		StartsAt:   req.StartsAt,
+		EndsAt:     req.EndsAt,
+		MinOrders:  req.MinOrders,
+		MaxOrders:  req.MaxOrders,
+		MinAccrual: req.MinAccrual,
+		Tiers:      req.Tiers,
+		BonusType:  req.BonusType,
+		BonusValue: req.BonusValue,
+		Active:     active,
+	}
+}
+
+func campaignModel(c repository.Campaign) models.Campaign {
+	return models.Campaign{
+		ID:         c.ID,
+		Name:       c.Name,
+		StartsAt:   c.StartsAt,
+		EndsAt:     c.EndsAt,
+		MinOrders:  c.MinOrders,
+		MaxOrders:  c.MaxOrders,
+		MinAccrual: c.MinAccrual,
+		Tiers:      c.Tiers,
+		BonusType:  c.BonusType,
+		BonusValue: c.BonusValue,
+		Active:     c.Active,
+	}
+}
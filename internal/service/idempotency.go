@@ -0,0 +1,107 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/1Asi1/gophermart/internal/models"
+	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/1Asi1/gophermart/internal/repository"
+	"github.com/google/uuid"
+	"golang.org/x/net/context"
+)
+
+const (
+	idempotencyKeyTTL = 24 * time.Hour
+	// idempotencyKeyLease outlasts any request, a key still in progress after
+	// it belongs to a request that crashed and is reserved again.
+	idempotencyKeyLease = time.Minute
+)
+
+// BeginIdempotent reserves the key for the request. When the key was already
+// used for the same request, the stored response is returned with replay set.
+func (s *Service) BeginIdempotent(
+	ctx context.Context,
+	id uuid.UUID,
+	key, hash string,
+) (resp models.IdempotentResponse, replay bool, err error) {
+	model := repository.IdempotencyKey{
+		UserID:      id,
+		Key:         key,
+		RequestHash: hash,
+	}
+
+	ok, err := s.store.ReserveIdempotencyKey(ctx, model, idempotencyKeyTTL, idempotencyKeyLease)
+	if err != nil {
+		return models.IdempotentResponse{}, false, fmt.Errorf("s.store.ReserveIdempotencyKey: %w", err)
+	}
+	if ok {
+		return models.IdempotentResponse{}, false, nil
+	}
+
+	stored, err := s.store.IdempotencyKey(ctx, id, key)
+	if err != nil {
+		return models.IdempotentResponse{}, false, fmt.Errorf("s.store.IdempotencyKey: %w", err)
+	}
+
+	if stored.RequestHash != hash {
+		return models.IdempotentResponse{}, false, oops.ErrIdempotencyKeyReused
+	}
+
+	if stored.StatusCode == nil {
+		return models.IdempotentResponse{}, false, oops.ErrIdempotencyInProgress
+	}
+
+	resp = models.IdempotentResponse{
+		StatusCode: *stored.StatusCode,
+		Body:       stored.ResponseBody,
+	}
+	if stored.ContentType != nil {
+		resp.ContentType = *stored.ContentType
+	}
+
+	return resp, true, nil
+}
+
+func (s *Service) FinishIdempotent(
+	ctx context.Context,
+	id uuid.UUID,
+	key string,
+	resp models.IdempotentResponse,
+) error {
+	model := repository.IdempotencyKey{
+		UserID:       id,
+		Key:          key,
+		StatusCode:   &resp.StatusCode,
+		ResponseBody: resp.Body,
+	}
+	if resp.ContentType != "" {
+		model.ContentType = &resp.ContentType
+	}
+
+	if err := s.store.SaveIdempotencyKey(ctx, model); err != nil {
+		return fmt.Errorf("s.store.SaveIdempotencyKey: %w", err)
+	}
+
+	return nil
+}
+
+// ReleaseIdempotent forgets the key so a failed request can be retried.
+func (s *Service) ReleaseIdempotent(ctx context.Context, id uuid.UUID, key string) error {
+	if err := s.store.DeleteIdempotencyKey(ctx, id, key); err != nil {
+		return fmt.Errorf("s.store.DeleteIdempotencyKey: %w", err)
+	}
+
+	return nil
+}
+
+// PurgeIdempotencyKeys deletes the keys past their TTL, they are never
+// replayed again. It returns how many were deleted.
+func (s *Service) PurgeIdempotencyKeys(ctx context.Context) (int64, error) {
+	n, err := s.store.PurgeIdempotencyKeys(ctx, idempotencyKeyTTL)
+	if err != nil {
+		return 0, fmt.Errorf("s.store.PurgeIdempotencyKeys: %w", err)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/1Asi1/gophermart/internal/models"
+	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/1Asi1/gophermart/internal/repository"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/context"
+)
+
+const passwordResetTTL = time.Hour
+
+// UserLogin is the login of the user, a new password must differ from it.
+func (s *Service) UserLogin(ctx context.Context, id uuid.UUID) (string, error) {
+	user, err := s.store.UserByID(ctx, id)
+	if err != nil {
+		return "", fmt.Errorf("s.store.UserByID: %w", err)
+	}
+
+	return user.Login, nil
+}
+
+// ChangePassword sets a new password and rotates the token, so every other
+// session of the user is signed out. The new token is returned to the caller.
+// A wrong current password counts as a failed login of the user and the ip.
+func (s *Service) ChangePassword(
+	ctx context.Context,
+	id uuid.UUID,
+	req models.PasswordChangeRequest,
+	ip string,
+) (string, error) {
+	user, err := s.store.UserByID(ctx, id)
+	if err != nil {
+		return "", fmt.Errorf("s.store.UserByID: %w", err)
+	}
+
+	attempts := []repository.LoginAttempt{
+		{Scope: repository.AttemptScopeLogin, Key: user.Login},
+		{Scope: repository.AttemptScopeIP, Key: ip},
+	}
+	if err = s.checkLocked(ctx, attempts); err != nil {
+		return "", err
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return "", fmt.Errorf("newToken: %w", err)
+	}
+
+	model := repository.User{
+		Password: getHashPassword(req.NewPassword),
+		Token:    token,
+	}
+
+	err = s.store.ChangePassword(ctx, id, getHashPassword(req.CurrentPassword), model)
+	if err != nil {
+		if errors.Is(err, oops.ErrInvalidCredentials) {
+			s.loginFailed(ctx, attempts)
+		}
+		return "", fmt.Errorf("s.store.ChangePassword: %w", err)
+	}
+
+	if err = s.store.ResetLoginFailures(ctx, attempts[0]); err != nil {
+		log.Error().Err(err).Msg("s.store.ResetLoginFailures")
+	}
+
+	return token, nil
+}
+
+// RequestPasswordReset sends a single use reset token. Unknown logins are not
+// reported to the caller, so the endpoint cannot be used to probe accounts.
+// Every request counts against the login and the ip like a failed login, so
+// the endpoint cannot flood a mailbox either.
+func (s *Service) RequestPasswordReset(ctx context.Context, req models.PasswordResetRequest, ip string) error {
+	attempts := []repository.LoginAttempt{
+		{Scope: repository.AttemptScopeReset, Key: req.Login},
+		{Scope: repository.AttemptScopeIP, Key: ip},
+	}
+	if err := s.checkLocked(ctx, attempts); err != nil {
+		return err
+	}
+	s.loginFailed(ctx, attempts)
+
+	user, err := s.store.UserByLogin(ctx, req.Login)
+	if err != nil {
+		if errors.Is(err, oops.ErrUserNotFound) {
+			return nil
+		}
+		return fmt.Errorf("s.store.UserByLogin: %w", err)
+	}
+
+	if user.Blocked {
+		return nil
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return fmt.Errorf("newToken: %w", err)
+	}
+
+	reset := repository.PasswordReset{
+		TokenHash: getHashPassword(token),
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(passwordResetTTL),
+	}
+	if err = s.store.CreatePasswordReset(ctx, reset); err != nil {
+		return fmt.Errorf("s.store.CreatePasswordReset: %w", err)
+	}
+
+	if err = s.notifier.SendPasswordReset(ctx, user.Login, token); err != nil {
+		log.Error().Err(err).Msg("s.notifier.SendPasswordReset")
+	}
+
+	return nil
+}
+
+func (s *Service) ConfirmPasswordReset(ctx context.Context, req models.PasswordResetConfirm) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", fmt.Errorf("newToken: %w", err)
+	}
+
+	model := repository.User{
+		Password: getHashPassword(req.NewPassword),
+		Token:    token,
+	}
+
+	if err = s.store.ResetPassword(ctx, getHashPassword(req.Token), model); err != nil {
+		return "", fmt.Errorf("s.store.ResetPassword: %w", err)
+	}
+
+	return token, nil
+}
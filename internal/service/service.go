@@ -1,60 +1,228 @@
 package service
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"time"
 
+	"github.com/1Asi1/gophermart/internal/events"
 	"github.com/1Asi1/gophermart/internal/integration/accrual"
+	"github.com/1Asi1/gophermart/internal/integration/notifier"
+	"github.com/1Asi1/gophermart/internal/integration/webhook"
 	"github.com/1Asi1/gophermart/internal/models"
 	"github.com/1Asi1/gophermart/internal/oops"
 	"github.com/1Asi1/gophermart/internal/repository"
 	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
 	"golang.org/x/net/context"
 )
 
+const (
+	loginFailureWindow = 15 * time.Minute
+	loginMaxFailures   = 5
+	ipMaxFailures      = 20
+	lockoutBase        = 30 * time.Second
+	lockoutMax         = time.Hour
+	lockoutMaxShift    = 16
+
+	tokenSize = 32
+	// referralCodeAttempts bounds the codes drawn at registration, one of 32^8
+	// is taken already only rarely.
+	referralCodeAttempts = 3
+)
+
 type Store interface {
 	Register(context.Context, repository.User) error
 	Login(context.Context, repository.User) (string, error)
-	CheckToken(context.Context, string) (uuid.UUID, error)
+	CheckToken(context.Context, string) (repository.User, error)
 	CreateOrder(context.Context, repository.Order) error
+	CreateOrders(context.Context, uuid.UUID, []string) ([]repository.OrderUpload, error)
 	Order(context.Context, uuid.UUID, string) (repository.Order, error)
 	Orders(context.Context, uuid.UUID) ([]repository.Order, error)
+	OrderEvents(context.Context, uuid.UUID, string) ([]repository.OrderEvent, error)
 	Balance(context.Context, uuid.UUID) (repository.Balance, error)
-	Withdraw(context.Context, repository.Order, float32) error
+	RepairBalances(context.Context) (int64, error)
+	ExpiringPoints(context.Context, uuid.UUID, time.Time) (repository.Expiring, error)
+	UsersWithExpiredPoints(context.Context) ([]uuid.UUID, error)
+	ExpirePoints(context.Context, uuid.UUID) (repository.Balance, float32, error)
+	UsersWithMaturedPoints(context.Context) ([]uuid.UUID, error)
+	ReleasePoints(context.Context, uuid.UUID) (repository.Balance, float32, error)
+	Withdraw(context.Context, repository.Withdrawals, repository.Notify[repository.Withdrawals]) (repository.Balance, error)
 	Withdrawals(context.Context, uuid.UUID) ([]repository.Withdrawals, error)
+	ReserveIdempotencyKey(context.Context, repository.IdempotencyKey, time.Duration, time.Duration) (bool, error)
+	IdempotencyKey(context.Context, uuid.UUID, string) (repository.IdempotencyKey, error)
+	SaveIdempotencyKey(context.Context, repository.IdempotencyKey) error
+	DeleteIdempotencyKey(context.Context, uuid.UUID, string) error
+	PurgeIdempotencyKeys(context.Context, time.Duration) (int64, error)
+	SearchUsers(context.Context, string) ([]repository.User, error)
+	SetBlocked(context.Context, uuid.UUID, bool, repository.Audit[uuid.UUID]) error
+	RequeueOrder(context.Context, string, repository.Audit[repository.Order]) (repository.Order, error)
+	AdjustBalance(
+		context.Context,
+		repository.Adjustment,
+		repository.Audit[repository.Balance],
+	) (repository.Balance, error)
+	ReverseWithdrawal(
+		context.Context,
+		repository.Reversal,
+		repository.Notify[repository.Withdrawals],
+		repository.Audit[repository.Reversed],
+	) (repository.Withdrawals, repository.Balance, error)
+	ClawbackOrder(
+		context.Context,
+		repository.Clawback,
+		repository.Notify[repository.Clawed],
+		repository.Audit[repository.Clawed],
+	) (repository.Order, repository.Balance, float32, error)
+	AuthorizeHold(context.Context, repository.Hold) (repository.Hold, repository.Balance, error)
+	CaptureHold(
+		context.Context,
+		uuid.UUID,
+		uuid.UUID,
+		repository.Notify[repository.Hold],
+	) (repository.Hold, repository.Balance, error)
+	VoidHold(context.Context, uuid.UUID, uuid.UUID, string) (repository.Hold, repository.Balance, error)
+	ExpiredHolds(context.Context) ([]repository.Hold, error)
+	Transfer(
+		context.Context,
+		repository.Transfer,
+		float32,
+		repository.Notify[repository.Transfer],
+	) (repository.Balance, repository.Balance, error)
+	Transfers(context.Context, uuid.UUID) ([]repository.Transfer, error)
+	UserAccrued(context.Context, uuid.UUID, time.Time) (repository.Accrued, error)
+	ReferralStats(context.Context, uuid.UUID) (repository.ReferralStats, error)
+	AccruedTotals(context.Context, time.Time) ([]repository.Accrued, error)
+	SetTier(context.Context, uuid.UUID, string) error
+	Campaigns(context.Context) ([]repository.Campaign, error)
+	CreateCampaign(
+		context.Context,
+		repository.Campaign,
+		repository.Audit[repository.Campaign],
+	) (repository.Campaign, error)
+	UpdateCampaign(
+		context.Context,
+		repository.Campaign,
+		repository.Audit[repository.Campaign],
+	) (repository.Campaign, error)
+	DeactivateCampaign(context.Context, int64, repository.Audit[int64]) error
+	CreateWebhook(
+		context.Context,
+		repository.Webhook,
+		repository.Audit[repository.Webhook],
+	) (repository.Webhook, error)
+	Webhooks(context.Context) ([]repository.Webhook, error)
+	DeactivateWebhook(context.Context, uuid.UUID, repository.Audit[uuid.UUID]) error
+	CreateAuditLog(context.Context, repository.AuditLog) error
+	SetRole(context.Context, uuid.UUID, string, []string, repository.Audit[uuid.UUID]) error
+	CreateAPIKey(context.Context, repository.APIKey, repository.Audit[repository.APIKey]) error
+	CheckAPIKey(context.Context, string) (repository.APIKey, error)
+	RevokeAPIKey(context.Context, uuid.UUID, repository.Audit[uuid.UUID]) error
+	LockedUntil(context.Context, []repository.LoginAttempt) (time.Time, error)
+	AddLoginFailure(context.Context, repository.LoginAttempt, time.Duration) (int, error)
+	LockLogin(context.Context, repository.LoginAttempt, time.Duration) error
+	ResetLoginFailures(context.Context, repository.LoginAttempt) error
+	UserByLogin(context.Context, string) (repository.User, error)
+	UserByID(context.Context, uuid.UUID) (repository.User, error)
+	ChangePassword(context.Context, uuid.UUID, string, repository.User) error
+	CreatePasswordReset(context.Context, repository.PasswordReset) error
+	ResetPassword(context.Context, string, repository.User) error
+}
+
+type Config struct {
+	// AdminTokens maps an operator name to the token of the admin API.
+	AdminTokens map[string]string
+	// PointsExpiryMonths is how long credited points live, zero keeps them forever.
+	PointsExpiryMonths int
+	// ExpiringSoon is the window of the balance expiring_soon field.
+	ExpiringSoon time.Duration
+	// HoldTTL is how long an authorized hold waits for capture.
+	HoldTTL time.Duration
+	// TransferDailyLimit caps the points a user sends per day, zero means no limit.
+	TransferDailyLimit float32
+	// Tiers are reached by the points accrued within TierWindow.
+	Tiers      models.Tiers
+	TierWindow time.Duration
 }
 
 type Service struct {
-	store  Store
-	client accrual.Client
+	store    Store
+	client   accrual.Client
+	hub      *events.Hub
+	notifier notifier.Notifier
+	cfg      Config
 }
 
-func New(store Store, client accrual.Client) Service {
-	return Service{store: store, client: client}
+func New(
+	store Store,
+	client accrual.Client,
+	hub *events.Hub,
+	notifier notifier.Notifier,
+	cfg Config,
+) Service {
+	return Service{
+		store:    store,
+		client:   client,
+		hub:      hub,
+		notifier: notifier,
+		cfg:      cfg,
+	}
 }
 
-func (s *Service) Register(ctx context.Context, u models.UserRequest) (string, error) {
-	pass := getHashPassword(u)
+// Register creates the user with a referral code of its own, drawn again when
+// taken already. The ip is recorded with the user.
+func (s *Service) Register(ctx context.Context, u models.UserRequest, ip string) (string, error) {
+	pass := getHashPassword(u.Password)
 
-	token := getToken(u.Login, pass)
+	token, err := newToken()
+	if err != nil {
+		return "", fmt.Errorf("newToken: %w", err)
+	}
 
 	model := repository.User{
-		ID:       uuid.New(),
-		Login:    u.Login,
-		Password: pass,
-		Token:    token,
-	}
-	if err := s.store.Register(ctx, model); err != nil {
-		return "", fmt.Errorf(":%w", err)
+		ID:           uuid.New(),
+		Login:        u.Login,
+		Password:     pass,
+		Token:        token,
+		Tier:         s.cfg.Tiers.For(0).Name,
+		ReferredBy:   u.ReferralCode,
+		RegisteredIP: ip,
 	}
 
-	return token, nil
+	for attempt := 1; ; attempt++ {
+		model.ReferralCode, err = newReferralCode()
+		if err != nil {
+			return "", err
+		}
+
+		err = s.store.Register(ctx, model)
+		if errors.Is(err, oops.ErrReferralCodeTaken) && attempt < referralCodeAttempts {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf(":%w", err)
+		}
+
+		return token, nil
+	}
 }
 
-func (s *Service) Login(ctx context.Context, u models.UserRequest) (string, error) {
-	pass := getHashPassword(u)
+// Login checks the lockouts of both the login and the client IP before the
+// password, every failure extends them exponentially.
+func (s *Service) Login(ctx context.Context, u models.UserRequest, ip string) (string, error) {
+	attempts := []repository.LoginAttempt{
+		{Scope: repository.AttemptScopeLogin, Key: u.Login},
+		{Scope: repository.AttemptScopeIP, Key: ip},
+	}
+
+	if err := s.checkLocked(ctx, attempts); err != nil {
+		return "", err
+	}
+
+	pass := getHashPassword(u.Password)
 
 	model := repository.User{
 		Login:    u.Login,
@@ -63,19 +231,65 @@ func (s *Service) Login(ctx context.Context, u models.UserRequest) (string, erro
 
 	token, err := s.store.Login(ctx, model)
 	if err != nil {
+		if errors.Is(err, oops.ErrInvalidCredentials) {
+			s.loginFailed(ctx, attempts)
+		}
 		return "", fmt.Errorf(":%w", err)
 	}
 
+	if err = s.store.ResetLoginFailures(ctx, attempts[0]); err != nil {
+		log.Error().Err(err).Msg("s.store.ResetLoginFailures")
+	}
+
 	return token, nil
 }
 
-func (s *Service) CheckAccess(ctx context.Context, token string) (string, error) {
-	id, err := s.store.CheckToken(ctx, token)
+// checkLocked fails with oops.LockedError while any of attempts is locked.
+func (s *Service) checkLocked(ctx context.Context, attempts []repository.LoginAttempt) error {
+	lockedUntil, err := s.store.LockedUntil(ctx, attempts)
 	if err != nil {
-		return "", fmt.Errorf("s.store.CheckToken: %w", err)
+		return fmt.Errorf("s.store.LockedUntil: %w", err)
+	}
+	if !lockedUntil.IsZero() {
+		return oops.LockedError{RetryAfter: time.Until(lockedUntil)}
+	}
+
+	return nil
+}
+
+func (s *Service) loginFailed(ctx context.Context, attempts []repository.LoginAttempt) {
+	for _, v := range attempts {
+		failures, err := s.store.AddLoginFailure(ctx, v, loginFailureWindow)
+		if err != nil {
+			log.Error().Err(err).Msg("s.store.AddLoginFailure")
+			continue
+		}
+
+		limit := loginMaxFailures
+		if v.Scope == repository.AttemptScopeIP {
+			limit = ipMaxFailures
+		}
+		if failures < limit {
+			continue
+		}
+
+		if err = s.store.LockLogin(ctx, v, lockout(failures-limit)); err != nil {
+			log.Error().Err(err).Msg("s.store.LockLogin")
+		}
+	}
+}
+
+// lockout doubles from lockoutBase for every failure over the limit.
+func lockout(over int) time.Duration {
+	if over >= lockoutMaxShift {
+		return lockoutMax
 	}
 
-	return id.String(), nil
+	d := lockoutBase << over
+	if d > lockoutMax {
+		return lockoutMax
+	}
+	return d
 }
 
 func (s *Service) CreateOrder(ctx context.Context, req models.OrderRequest) error {
@@ -94,6 +308,45 @@ func (s *Service) CreateOrder(ctx context.Context, req models.OrderRequest) erro
 	return nil
 }
 
+// CreateOrders validates every number and uploads the valid ones at once.
+// The result keeps the order of the request, repeated numbers included.
+func (s *Service) CreateOrders(ctx context.Context, id uuid.UUID, numbers []string) ([]models.OrderUpload, error) {
+	statuses := make(map[string]string, len(numbers))
+	valid := make([]string, 0, len(numbers))
+	for _, v := range numbers {
+		if _, ok := statuses[v]; ok {
+			continue
+		}
+
+		req := models.OrderRequest{UserID: id, Number: v}
+		if err := req.Validate(); err != nil {
+			statuses[v] = models.UploadInvalid
+			continue
+		}
+
+		statuses[v] = ""
+		valid = append(valid, v)
+	}
+
+	if len(valid) > 0 {
+		uploads, err := s.store.CreateOrders(ctx, id, valid)
+		if err != nil {
+			return nil, fmt.Errorf("s.store.CreateOrders: %w", err)
+		}
+
+		for _, v := range uploads {
+			statuses[v.Number] = v.Result
+		}
+	}
+
+	result := make([]models.OrderUpload, len(numbers))
+	for i, v := range numbers {
+		result[i] = models.OrderUpload{Number: v, Status: statuses[v]}
+	}
+
+	return result, nil
+}
+
 func (s *Service) Orders(ctx context.Context, id uuid.UUID) ([]models.Order, error) {
 	orders, err := s.store.Orders(ctx, id)
 	if err != nil {
@@ -113,44 +366,314 @@ func (s *Service) Orders(ctx context.Context, id uuid.UUID) ([]models.Order, err
 	return result, nil
 }
 
+func (s *Service) OrderEvents(ctx context.Context, id uuid.UUID, number string) ([]models.OrderEvent, error) {
+	events, err := s.store.OrderEvents(ctx, id, number)
+	if err != nil {
+		return nil, fmt.Errorf(":%w", err)
+	}
+
+	result := make([]models.OrderEvent, len(events))
+	for i, v := range events {
+		result[i] = models.OrderEvent{
+			PreviousStatus: v.PreviousStatus,
+			Status:         v.Status,
+			Accrual:        v.Accrual,
+			Payload:        v.Payload,
+			CreatedAt:      v.CreatedAt,
+		}
+	}
+
+	return result, nil
+}
+
 func (s *Service) Balance(ctx context.Context, id uuid.UUID) (models.Balance, error) {
 	balance, err := s.store.Balance(ctx, id)
 	if err != nil {
 		return models.Balance{}, fmt.Errorf(":%w", err)
 	}
 
+	expiring, err := s.store.ExpiringPoints(ctx, id, time.Now().Add(s.cfg.ExpiringSoon))
+	if err != nil {
+		return models.Balance{}, fmt.Errorf(":%w", err)
+	}
+
 	return models.Balance{
-		Current:   balance.Current,
-		Withdrawn: balance.Withdrawn,
+		Current:      balance.Current,
+		Pending:      balance.Pending,
+		Held:         balance.Held,
+		Withdrawn:    balance.Withdrawn,
+		Debt:         balance.Debt,
+		ExpiringSoon: expiring.Sum,
+		ExpiringAt:   expiring.NextAt,
 	}, nil
 }
 
+// ExpirePoints writes off expired lots user by user, a failure for one user
+// does not stop the others.
+func (s *Service) ExpirePoints(ctx context.Context) error {
+	ids, err := s.store.UsersWithExpiredPoints(ctx)
+	if err != nil {
+		return fmt.Errorf(":%w", err)
+	}
+
+	for _, id := range ids {
+		balance, sum, err := s.store.ExpirePoints(ctx, id)
+		if err != nil {
+			log.Error().Err(err).Str("user", id.String()).Msg("s.store.ExpirePoints")
+			continue
+		}
+
+		if sum > 0 {
+			s.hub.Publish(id, events.TypeBalance, models.Balance{
+				Current:   balance.Current,
+				Pending:   balance.Pending,
+				Held:      balance.Held,
+				Withdrawn: balance.Withdrawn,
+				Debt:      balance.Debt,
+			})
+		}
+	}
+
+	return nil
+}
+
+// ReleasePoints makes accruals whose hold is over available, user by user.
+func (s *Service) ReleasePoints(ctx context.Context) error {
+	ids, err := s.store.UsersWithMaturedPoints(ctx)
+	if err != nil {
+		return fmt.Errorf(":%w", err)
+	}
+
+	for _, id := range ids {
+		balance, sum, err := s.store.ReleasePoints(ctx, id)
+		if err != nil {
+			log.Error().Err(err).Str("user", id.String()).Msg("s.store.ReleasePoints")
+			continue
+		}
+
+		if sum > 0 {
+			s.hub.Publish(id, events.TypeBalance, models.Balance{
+				Current:   balance.Current,
+				Pending:   balance.Pending,
+				Held:      balance.Held,
+				Withdrawn: balance.Withdrawn,
+				Debt:      balance.Debt,
+			})
+		}
+	}
+
+	return nil
+}
+
+// RepairBalances creates balance rows for users registered without one.
+func (s *Service) RepairBalances(ctx context.Context) (int64, error) {
+	n, err := s.store.RepairBalances(ctx)
+	if err != nil {
+		return 0, fmt.Errorf(":%w", err)
+	}
+
+	return n, nil
+}
+
 func (s *Service) Withdraw(ctx context.Context, id uuid.UUID, req models.WithdrawRequest) error {
-	balance, err := s.store.Balance(ctx, id)
+	model := repository.Withdrawals{
+		UserID:     id,
+		Number:     req.Order,
+		Sum:        req.Sum,
+		MerchantID: req.Merchant,
+	}
+
+	balance, err := s.store.Withdraw(ctx, model, func(w repository.Withdrawals) ([]repository.WebhookEvent, error) {
+		return webhook.NewEvents(webhook.EventWithdrawalMade, id, models.Withdraw{
+			Order:       w.Number,
+			Sum:         w.Sum,
+			ProcessedAt: w.ProcessedAt,
+		})
+	})
+	if err != nil {
+		return fmt.Errorf(":%w", err)
+	}
+
+	s.hub.Publish(id, events.TypeBalance, models.Balance{
+		Current:   balance.Current,
+		Pending:   balance.Pending,
+		Held:      balance.Held,
+		Withdrawn: balance.Withdrawn,
+		Debt:      balance.Debt,
+	})
+
+	return nil
+}
+
+// AuthorizeHold reserves points for an order, they stay off the available
+// balance until the hold is captured, voided or expires.
+func (s *Service) AuthorizeHold(ctx context.Context, id uuid.UUID, req models.WithdrawRequest) (models.Hold, error) {
+	hold, balance, err := s.store.AuthorizeHold(ctx, repository.Hold{
+		ID:         uuid.New(),
+		UserID:     id,
+		Number:     req.Order,
+		Sum:        req.Sum,
+		MerchantID: req.Merchant,
+		ExpiresAt:  time.Now().Add(s.cfg.HoldTTL),
+	})
 	if err != nil {
-		return fmt.Errorf("s.store.Balance: %w", err)
+		return models.Hold{}, fmt.Errorf(":%w", err)
 	}
 
-	if balance.Current-req.Sum < 0 {
-		return oops.ErrInsufficientFunds
+	s.publishBalance(id, balance)
+
+	return holdModel(hold), nil
+}
+
+// CaptureHold turns the hold into a withdrawal.
+func (s *Service) CaptureHold(ctx context.Context, userID, id uuid.UUID) (models.Hold, error) {
+	hold, balance, err := s.store.CaptureHold(ctx, userID, id, func(h repository.Hold) ([]repository.WebhookEvent, error) {
+		return webhook.NewEvents(webhook.EventWithdrawalMade, userID, models.Withdraw{
+			Order:       h.Number,
+			Sum:         h.Sum,
+			ProcessedAt: *h.ClosedAt,
+		})
+	})
+	if err != nil {
+		return models.Hold{}, fmt.Errorf(":%w", err)
 	}
 
-	balance.Current -= req.Sum
+	s.publishBalance(userID, balance)
 
-	model := repository.Order{
-		UserID:  id,
-		Number:  req.Order,
-		Accrual: &balance.Current,
+	return holdModel(hold), nil
+}
+
+func (s *Service) VoidHold(ctx context.Context, userID, id uuid.UUID) (models.Hold, error) {
+	hold, balance, err := s.store.VoidHold(ctx, userID, id, repository.HoldStatusVoided)
+	if err != nil {
+		return models.Hold{}, fmt.Errorf(":%w", err)
 	}
 
-	err = s.store.Withdraw(ctx, model, req.Sum)
+	s.publishBalance(userID, balance)
+
+	return holdModel(hold), nil
+}
+
+// ExpireHolds voids the holds nobody captured in time.
+func (s *Service) ExpireHolds(ctx context.Context) error {
+	holds, err := s.store.ExpiredHolds(ctx)
 	if err != nil {
 		return fmt.Errorf(":%w", err)
 	}
 
+	for _, v := range holds {
+		_, balance, err := s.store.VoidHold(ctx, v.UserID, v.ID, repository.HoldStatusExpired)
+		if err != nil {
+			log.Error().Err(err).Str("hold", v.ID.String()).Msg("s.store.VoidHold")
+			continue
+		}
+
+		s.publishBalance(v.UserID, balance)
+	}
+
 	return nil
 }
 
+// Transfer sends points to the user with the given login, key is the
+// Idempotency-Key of the request and keeps a retried transfer from running twice.
+func (s *Service) Transfer(
+	ctx context.Context,
+	id uuid.UUID,
+	key string,
+	req models.TransferRequest,
+) (models.Transfer, error) {
+	recipient, err := s.store.UserByLogin(ctx, models.NormalizeLogin(req.Login))
+	if err != nil {
+		return models.Transfer{}, fmt.Errorf(":%w", err)
+	}
+
+	if recipient.Blocked {
+		return models.Transfer{}, oops.ErrUserNotFound
+	}
+
+	if recipient.ID == id {
+		return models.Transfer{}, oops.ErrTransferInvalid
+	}
+
+	transfer := repository.Transfer{
+		ID:             uuid.New(),
+		FromUserID:     id,
+		ToUserID:       recipient.ID,
+		Sum:            req.Sum,
+		Comment:        req.Comment,
+		IdempotencyKey: key,
+	}
+
+	var result models.Transfer
+	from, to, err := s.store.Transfer(ctx, transfer, s.cfg.TransferDailyLimit,
+		func(t repository.Transfer) ([]repository.WebhookEvent, error) {
+			result = models.Transfer{
+				ID:        t.ID,
+				Direction: models.TransferOutgoing,
+				Login:     recipient.Login,
+				Sum:       t.Sum,
+				Comment:   t.Comment,
+				CreatedAt: t.CreatedAt,
+			}
+			return webhook.NewEvents(webhook.EventTransferMade, id, result)
+		})
+	if err != nil {
+		return models.Transfer{}, fmt.Errorf(":%w", err)
+	}
+
+	s.publishBalance(id, from)
+	s.publishBalance(recipient.ID, to)
+
+	return result, nil
+}
+
+func (s *Service) Transfers(ctx context.Context, id uuid.UUID) ([]models.Transfer, error) {
+	transfers, err := s.store.Transfers(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf(":%w", err)
+	}
+
+	result := make([]models.Transfer, len(transfers))
+	for i, v := range transfers {
+		result[i] = models.Transfer{
+			ID:        v.ID,
+			Direction: models.TransferOutgoing,
+			Login:     v.ToLogin,
+			Sum:       v.Sum,
+			Comment:   v.Comment,
+			CreatedAt: v.CreatedAt,
+		}
+		if v.ToUserID == id {
+			result[i].Direction = models.TransferIncoming
+			result[i].Login = v.FromLogin
+		}
+	}
+
+	return result, nil
+}
+
+func (s *Service) publishBalance(id uuid.UUID, balance repository.Balance) {
+	s.hub.Publish(id, events.TypeBalance, models.Balance{
+		Current:   balance.Current,
+		Pending:   balance.Pending,
+		Held:      balance.Held,
+		Withdrawn: balance.Withdrawn,
+		Debt:      balance.Debt,
+	})
+}
+
+func holdModel(hold repository.Hold) models.Hold {
+	return models.Hold{
+		ID:        hold.ID,
+		Order:     hold.Number,
+		Sum:       hold.Sum,
+		Status:    hold.Status,
+		CreatedAt: hold.CreatedAt,
+		ExpiresAt: hold.ExpiresAt,
+		ClosedAt:  hold.ClosedAt,
+	}
+}
+
 func (s *Service) Withdrawals(ctx context.Context, id uuid.UUID) ([]models.Withdraw, error) {
 	result, err := s.store.Withdrawals(ctx, id)
 	if err != nil {
@@ -159,25 +682,52 @@ func (s *Service) Withdrawals(ctx context.Context, id uuid.UUID) ([]models.Withd
 
 	withdrawals := make([]models.Withdraw, len(result))
 	for i, v := range result {
-		withdrawals[i] = models.Withdraw{
-			Order:       v.Number,
-			Sum:         v.Sum,
-			ProcessedAt: v.ProcessedAt,
-		}
+		withdrawals[i] = withdrawModel(v)
 	}
 
 	return withdrawals, nil
 }
 
-func getHashPassword(u models.UserRequest) string {
-	hash := sha256.Sum256([]byte(u.Password))
+func withdrawModel(w repository.Withdrawals) models.Withdraw {
+	return models.Withdraw{
+		Order:       w.Number,
+		Sum:         w.Sum,
+		Status:      w.Status,
+		Reversed:    w.Reversed,
+		ProcessedAt: w.ProcessedAt,
+	}
+}
+
+func (s *Service) Subscribe(id uuid.UUID, lastID int64) (<-chan events.Event, []events.Event, func()) {
+	return s.hub.Subscribe(id, lastID)
+}
+
+func getHashPassword(password string) string {
+	hash := sha256.Sum256([]byte(password))
 	return hex.EncodeToString(hash[:])
 }
 
-func getToken(login, password string) string {
-	tokenString := fmt.Sprintf("%s%s", login, password)
-	hash := sha256.Sum256([]byte(tokenString))
-	token := hex.EncodeToString(hash[:])
+// newToken returns a random session token, it is not derived from the
+// password so it can be rotated on its own.
+func newToken() (string, error) {
+	buf := make([]byte, tokenSize)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("rand.Read: %w", err)
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+func newReferralCode() (string, error) {
+	buf := make([]byte, models.ReferralCodeLen)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("rand.Read: %w", err)
+	}
+
+	// The alphabet has 32 characters, a byte modulo 32 keeps them uniform.
+	for i, v := range buf {
+		buf[i] = models.ReferralCodeAlphabet[int(v)%len(models.ReferralCodeAlphabet)]
+	}
 
-	return token
+	return string(buf), nil
 }
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/1Asi1/gophermart/internal/models"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/context"
+)
+
+// Profile shows the tier of the user and how far the next one is. The tier is
+// the one stored by the nightly recompute, not the one the accrued points
+// would give right now.
+func (s *Service) Profile(ctx context.Context, id uuid.UUID) (models.Profile, error) {
+	since := time.Now().Add(-s.cfg.TierWindow)
+	accrued, err := s.store.UserAccrued(ctx, id, since)
+	if err != nil {
+		return models.Profile{}, fmt.Errorf(":%w", err)
+	}
+
+	referrals, err := s.store.ReferralStats(ctx, id)
+	if err != nil {
+		return models.Profile{}, fmt.Errorf(":%w", err)
+	}
+
+	return models.Profile{
+		Login:      accrued.Login,
+		Role:       accrued.Role,
+		Tier:       accrued.Tier,
+		Multiplier: s.cfg.Tiers.Get(accrued.Tier).Multiplier,
+		Accrued:    accrued.Accrued,
+		Since:      since,
+		NextTier:   s.cfg.Tiers.Next(accrued.Tier),
+
+		ReferralCode: referrals.Code,
+		Invited:      referrals.Invited,
+		Rewarded:     referrals.Rewarded,
+	}, nil
+}
+
+// RecomputeTiers moves every user to the tier of the points accrued within the
+// window, only changed tiers are written.
+func (s *Service) RecomputeTiers(ctx context.Context) error {
+	totals, err := s.store.AccruedTotals(ctx, time.Now().Add(-s.cfg.TierWindow))
+	if err != nil {
+		return fmt.Errorf(":%w", err)
+	}
+
+	var changed int
+	for _, v := range totals {
+		tier := s.cfg.Tiers.For(v.Accrued)
+		if tier.Name == v.Tier {
+			continue
+		}
+
+		if err = s.store.SetTier(ctx, v.UserID, tier.Name); err != nil {
+			log.Error().Err(err).Str("user", v.UserID.String()).Msg("s.store.SetTier")
+			continue
+		}
+		changed++
+	}
+
+	log.Info().Int("changed", changed).Msg("tiers recomputed")
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/1Asi1/gophermart/internal/integration/webhook"
+	"github.com/1Asi1/gophermart/internal/models"
+	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/1Asi1/gophermart/internal/repository"
+	"github.com/google/uuid"
+)
+
+const (
+	auditWebhookCreate     = "webhook.create"
+	auditWebhookDeactivate = "webhook.deactivate"
+)
+
+func (s *Service) Webhooks(ctx context.Context) ([]models.Webhook, error) {
+	webhooks, err := s.store.Webhooks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("s.store.Webhooks: %w", err)
+	}
+
+	result := make([]models.Webhook, len(webhooks))
+	for i, v := range webhooks {
+		result[i] = webhookModel(v)
+		result[i].Secret = ""
+	}
+
+	return result, nil
+}
+
+// CreateWebhook subscribes the endpoint to the event types, the secret to
+// check the signatures with is returned only here.
+func (s *Service) CreateWebhook(ctx context.Context, operator string, req models.WebhookRequest) (models.Webhook, error) {
+	for _, v := range req.EventTypes {
+		if !webhook.Known(v) {
+			return models.Webhook{}, oops.ErrWebhookInvalid
+		}
+	}
+
+	secret, err := newToken()
+	if err != nil {
+		return models.Webhook{}, fmt.Errorf("newToken: %w", err)
+	}
+
+	created, err := s.store.CreateWebhook(ctx, repository.Webhook{
+		ID:         uuid.New(),
+		URL:        req.URL,
+		Secret:     secret,
+		EventTypes: req.EventTypes,
+	}, func(w repository.Webhook) (repository.AuditLog, error) {
+		return newAuditLog(operator, auditWebhookCreate, nil, map[string]any{
+			"id":          w.ID,
+			"url":         w.URL,
+			"event_types": w.EventTypes,
+		})
+	})
+	if err != nil {
+		return models.Webhook{}, fmt.Errorf("s.store.CreateWebhook: %w", err)
+	}
+
+	return webhookModel(created), nil
+}
+
+func (s *Service) DeactivateWebhook(ctx context.Context, operator string, id uuid.UUID) error {
+	err := s.store.DeactivateWebhook(ctx, id,
+		audit[uuid.UUID](operator, auditWebhookDeactivate, nil, map[string]uuid.UUID{"id": id}))
+	if err != nil {
+		return fmt.Errorf("s.store.DeactivateWebhook: %w", err)
+	}
+
+	return nil
+}
+
+func webhookModel(w repository.Webhook) models.Webhook {
+	return models.Webhook{
+		ID:         w.ID,
+		URL:        w.URL,
+		Secret:     w.Secret,
+		EventTypes: w.EventTypes,
+		Active:     w.Active,
+		CreatedAt:  w.CreatedAt,
+	}
+}
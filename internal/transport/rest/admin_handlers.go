@@ -0,0 +1,599 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/1Asi1/gophermart/internal/models"
+	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+func (h *handlers) adminSearchUsers(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "adminSearchUsers").Logger()
+
+	login := r.URL.Query().Get("login")
+	if login == "" {
+		l.Error().Msg("empty login")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data, err := h.service.SearchUsers(r.Context(), r.Header.Get("Operator"), login)
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.SearchUsers")
+		if errors.Is(err, oops.ErrEmptyData) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, l, data)
+}
+
+func (h *handlers) adminGetOrders(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "adminGetOrders").Logger()
+
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		l.Error().Err(err).Msg("uuid.Parse key: id")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data, err := h.service.AdminOrders(r.Context(), r.Header.Get("Operator"), id)
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.AdminOrders")
+		if errors.Is(err, oops.ErrEmptyData) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, l, data)
+}
+
+func (h *handlers) adminGetOrderEvents(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "adminGetOrderEvents").Logger()
+
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		l.Error().Err(err).Msg("uuid.Parse key: id")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data, err := h.service.AdminOrderEvents(r.Context(), r.Header.Get("Operator"), id, chi.URLParam(r, "number"))
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.AdminOrderEvents")
+		if errors.Is(err, oops.ErrEmptyData) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, l, data)
+}
+
+func (h *handlers) adminGetBalance(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "adminGetBalance").Logger()
+
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		l.Error().Err(err).Msg("uuid.Parse key: id")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data, err := h.service.AdminBalance(r.Context(), r.Header.Get("Operator"), id)
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.AdminBalance")
+		if errors.Is(err, oops.ErrAccountNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, l, data)
+}
+
+func (h *handlers) adminGetWithdrawals(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "adminGetWithdrawals").Logger()
+
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		l.Error().Err(err).Msg("uuid.Parse key: id")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data, err := h.service.AdminWithdrawals(r.Context(), r.Header.Get("Operator"), id)
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.AdminWithdrawals")
+		if errors.Is(err, oops.ErrEmptyData) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, l, data)
+}
+
+func (h *handlers) adminRequeueOrder(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "adminRequeueOrder").Logger()
+
+	err := h.service.RequeueOrder(r.Context(), r.Header.Get("Operator"), chi.URLParam(r, "number"))
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.RequeueOrder")
+		if errors.Is(err, oops.ErrEmptyData) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if errors.Is(err, oops.ErrOrderProcessed) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *handlers) adminAdjustBalance(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "adminAdjustBalance").Logger()
+
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		l.Error().Err(err).Msg("uuid.Parse key: id")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var req models.AdjustmentRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		l.Error().Err(err).Msg("json.NewDecoder")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err = req.Validate(); err != nil {
+		l.Error().Err(err).Msg("req.Validate")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data, err := h.service.AdjustBalance(r.Context(), r.Header.Get("Operator"), id, req)
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.AdjustBalance")
+		if errors.Is(err, oops.ErrUserNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if errors.Is(err, oops.ErrInsufficientFunds) {
+			w.WriteHeader(http.StatusPaymentRequired)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, l, data)
+}
+
+func (h *handlers) adminReverseWithdrawal(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "adminReverseWithdrawal").Logger()
+
+	var req models.ReversalRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		l.Error().Err(err).Msg("json.NewDecoder")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err = req.Validate(); err != nil {
+		l.Error().Err(err).Msg("req.Validate")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Anyone but an admin refunds as a merchant, only its own withdrawals.
+	var merchant *uuid.UUID
+	if r.Header.Get("Role") != models.RoleAdmin {
+		id, err := uuid.Parse(r.Header.Get("ID"))
+		if err != nil {
+			l.Error().Err(err).Msg("uuid.Parse")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		merchant = &id
+	}
+
+	data, err := h.service.ReverseWithdrawal(r.Context(), r.Header.Get("Operator"), merchant, chi.URLParam(r, "number"), req)
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.ReverseWithdrawal")
+		if errors.Is(err, oops.ErrWithdrawalNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if errors.Is(err, oops.ErrReversalInvalid) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, l, data)
+}
+
+func (h *handlers) adminClawbackOrder(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "adminClawbackOrder").Logger()
+
+	var req models.ClawbackRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		l.Error().Err(err).Msg("json.NewDecoder")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err = req.Validate(); err != nil {
+		l.Error().Err(err).Msg("req.Validate")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data, err := h.service.ClawbackOrder(r.Context(), r.Header.Get("Operator"), chi.URLParam(r, "number"), req)
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.ClawbackOrder")
+		if errors.Is(err, oops.ErrEmptyData) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if errors.Is(err, oops.ErrClawbackInvalid) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, l, data)
+}
+
+func (h *handlers) adminBlockUser(w http.ResponseWriter, r *http.Request) {
+	h.adminSetBlocked(w, r, true)
+}
+
+func (h *handlers) adminUnblockUser(w http.ResponseWriter, r *http.Request) {
+	h.adminSetBlocked(w, r, false)
+}
+
+func (h *handlers) adminSetBlocked(w http.ResponseWriter, r *http.Request, blocked bool) {
+	l := h.log.With().Str("route", "adminSetBlocked").Logger()
+
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		l.Error().Err(err).Msg("uuid.Parse key: id")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = h.service.SetBlocked(r.Context(), r.Header.Get("Operator"), id, blocked)
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.SetBlocked")
+		if errors.Is(err, oops.ErrUserNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *handlers) adminSetRole(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "adminSetRole").Logger()
+
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		l.Error().Err(err).Msg("uuid.Parse key: id")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var req models.RoleRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		l.Error().Err(err).Msg("json.NewDecoder")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err = req.Validate(); err != nil {
+		l.Error().Err(err).Msg("req.Validate")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = h.service.SetRole(r.Context(), r.Header.Get("Operator"), id, req)
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.SetRole")
+		if errors.Is(err, oops.ErrUserNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *handlers) adminCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "adminCreateAPIKey").Logger()
+
+	var req models.APIKeyRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		l.Error().Err(err).Msg("json.NewDecoder")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err = req.Validate(); err != nil {
+		l.Error().Err(err).Msg("req.Validate")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data, err := h.service.CreateAPIKey(r.Context(), r.Header.Get("Operator"), req)
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.CreateAPIKey")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, l, data)
+}
+
+func (h *handlers) adminRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "adminRevokeAPIKey").Logger()
+
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		l.Error().Err(err).Msg("uuid.Parse key: id")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = h.service.RevokeAPIKey(r.Context(), r.Header.Get("Operator"), id)
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.RevokeAPIKey")
+		if errors.Is(err, oops.ErrEmptyData) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handlers) adminGetCampaigns(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "adminGetCampaigns").Logger()
+
+	data, err := h.service.Campaigns(r.Context())
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.Campaigns")
+		if errors.Is(err, oops.ErrEmptyData) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, l, data)
+}
+
+func (h *handlers) adminCreateCampaign(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "adminCreateCampaign").Logger()
+
+	var req models.CampaignRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		l.Error().Err(err).Msg("json.NewDecoder")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err = req.Validate(); err != nil {
+		l.Error().Err(err).Msg("req.Validate")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data, err := h.service.CreateCampaign(r.Context(), r.Header.Get("Operator"), req)
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.CreateCampaign")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, l, data)
+}
+
+func (h *handlers) adminUpdateCampaign(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "adminUpdateCampaign").Logger()
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		l.Error().Err(err).Msg("strconv.ParseInt key: id")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var req models.CampaignRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		l.Error().Err(err).Msg("json.NewDecoder")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err = req.Validate(); err != nil {
+		l.Error().Err(err).Msg("req.Validate")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data, err := h.service.UpdateCampaign(r.Context(), r.Header.Get("Operator"), id, req)
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.UpdateCampaign")
+		if errors.Is(err, oops.ErrCampaignNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, l, data)
+}
+
+func (h *handlers) adminDeactivateCampaign(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "adminDeactivateCampaign").Logger()
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		l.Error().Err(err).Msg("strconv.ParseInt key: id")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = h.service.DeactivateCampaign(r.Context(), r.Header.Get("Operator"), id)
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.DeactivateCampaign")
+		if errors.Is(err, oops.ErrCampaignNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handlers) adminGetWebhooks(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "adminGetWebhooks").Logger()
+
+	data, err := h.service.Webhooks(r.Context())
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.Webhooks")
+		if errors.Is(err, oops.ErrEmptyData) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, l, data)
+}
+
+func (h *handlers) adminCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "adminCreateWebhook").Logger()
+
+	var req models.WebhookRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		l.Error().Err(err).Msg("json.NewDecoder")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err = req.Validate(); err != nil {
+		l.Error().Err(err).Msg("req.Validate")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data, err := h.service.CreateWebhook(r.Context(), r.Header.Get("Operator"), req)
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.CreateWebhook")
+		if errors.Is(err, oops.ErrWebhookInvalid) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, l, data)
+}
+
+func (h *handlers) adminDeactivateWebhook(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "adminDeactivateWebhook").Logger()
+
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		l.Error().Err(err).Msg("uuid.Parse key: id")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = h.service.DeactivateWebhook(r.Context(), r.Header.Get("Operator"), id)
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.DeactivateWebhook")
+		if errors.Is(err, oops.ErrWebhookNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,6 +1,9 @@
 package rest
 
 import (
+	"net/netip"
+
+	"github.com/1Asi1/gophermart/internal/models"
 	"github.com/1Asi1/gophermart/internal/service"
 	"github.com/1Asi1/gophermart/internal/transport/rest/middlewares"
 	"github.com/go-chi/chi/v5"
@@ -12,20 +15,70 @@ type APIRouter struct {
 	*chi.Mux
 }
 
-func New(s service.Service, log zerolog.Logger) APIRouter {
+// New serves the API, proxies are the peers trusted to tell the client address
+// in X-Forwarded-For.
+func New(s service.Service, policy models.Policy, proxies []netip.Prefix, log zerolog.Logger) APIRouter {
 	router := chi.NewRouter()
-	h := newHandlers(s, log)
+	h := newHandlers(s, policy, proxies, log)
 
 	router.Use(middleware.DefaultLogger)
 
 	router.Route("/api/user", func(r chi.Router) {
 		r.Post("/register", h.register)
 		r.Post("/login", h.login)
-		r.Post("/orders", middlewares.Authorization(h.createOrder, s))
-		r.Get("/orders", middlewares.Authorization(h.getOrders, s))
-		r.Get("/balance", middlewares.Authorization(h.getBalance, s))
-		r.Post("/balance/withdraw", middlewares.Authorization(h.withdraw, s))
-		r.Get("/withdrawals", middlewares.Authorization(h.getWithdrawals, s))
+		r.Post("/password", middlewares.Authorization(h.changePassword, s))
+		r.Post("/password/reset", h.requestPasswordReset)
+		r.Post("/password/reset/confirm", h.confirmPasswordReset)
+		r.Get("/profile", middlewares.Authorization(h.getProfile, s))
+		r.Post("/orders", middlewares.Authorization(middlewares.Idempotency(h.createOrder, s), s,
+			models.PermOrdersWrite))
+		r.Post("/orders/batch", middlewares.Authorization(h.createOrders, s, models.PermOrdersWrite))
+		r.Get("/orders", middlewares.Authorization(h.getOrders, s, models.PermOrdersRead))
+		r.Get("/orders/{number}/events", middlewares.Authorization(h.getOrderEvents, s, models.PermOrdersRead))
+		r.Get("/balance", middlewares.Authorization(h.getBalance, s, models.PermBalanceRead))
+		r.Post("/balance/withdraw", middlewares.Authorization(middlewares.Idempotency(h.withdraw, s), s,
+			models.PermBalanceWithdraw))
+		r.Post("/balance/holds", middlewares.Authorization(middlewares.Idempotency(h.authorizeHold, s), s,
+			models.PermBalanceWithdraw))
+		r.Post("/balance/holds/{id}/capture", middlewares.Authorization(h.captureHold, s,
+			models.PermBalanceWithdraw))
+		r.Post("/balance/holds/{id}/void", middlewares.Authorization(h.voidHold, s, models.PermBalanceWithdraw))
+		r.Post("/balance/transfer", middlewares.Authorization(middlewares.Idempotency(h.transfer, s), s,
+			models.PermBalanceWithdraw))
+		r.Get("/transfers", middlewares.Authorization(h.getTransfers, s, models.PermBalanceRead))
+		r.Get("/withdrawals", middlewares.Authorization(h.getWithdrawals, s, models.PermBalanceRead))
+		r.Get("/events", middlewares.Authorization(h.events, s, models.PermOrdersRead, models.PermBalanceRead))
+	})
+
+	router.Route("/api/admin", func(r chi.Router) {
+		r.Get("/users", middlewares.Authorization(h.adminSearchUsers, s, models.PermUsersRead))
+		r.Get("/users/{id}/orders", middlewares.Authorization(h.adminGetOrders, s, models.PermUsersRead))
+		r.Get("/users/{id}/orders/{number}/events", middlewares.Authorization(h.adminGetOrderEvents, s,
+			models.PermUsersRead))
+		r.Get("/users/{id}/balance", middlewares.Authorization(h.adminGetBalance, s, models.PermUsersRead))
+		r.Get("/users/{id}/withdrawals", middlewares.Authorization(h.adminGetWithdrawals, s, models.PermUsersRead))
+		r.Post("/users/{id}/adjustments", middlewares.Authorization(h.adminAdjustBalance, s,
+			models.PermBalanceAdjust))
+		r.Post("/users/{id}/block", middlewares.Authorization(h.adminBlockUser, s, models.PermUsersBlock))
+		r.Post("/users/{id}/unblock", middlewares.Authorization(h.adminUnblockUser, s, models.PermUsersBlock))
+		r.Put("/users/{id}/role", middlewares.Authorization(h.adminSetRole, s, models.PermAccessManage))
+		r.Post("/orders/{number}/requeue", middlewares.Authorization(h.adminRequeueOrder, s,
+			models.PermOrdersRequeue))
+		r.Post("/orders/{number}/clawback", middlewares.Authorization(h.adminClawbackOrder, s,
+			models.PermOrdersClawback))
+		r.Post("/withdrawals/{number}/reversals", middlewares.Authorization(h.adminReverseWithdrawal, s,
+			models.PermWithdrawReverse))
+		r.Get("/campaigns", middlewares.Authorization(h.adminGetCampaigns, s, models.PermCampaignsManage))
+		r.Post("/campaigns", middlewares.Authorization(h.adminCreateCampaign, s, models.PermCampaignsManage))
+		r.Put("/campaigns/{id}", middlewares.Authorization(h.adminUpdateCampaign, s, models.PermCampaignsManage))
+		r.Delete("/campaigns/{id}", middlewares.Authorization(h.adminDeactivateCampaign, s,
+			models.PermCampaignsManage))
+		r.Get("/webhooks", middlewares.Authorization(h.adminGetWebhooks, s, models.PermWebhooksManage))
+		r.Post("/webhooks", middlewares.Authorization(h.adminCreateWebhook, s, models.PermWebhooksManage))
+		r.Delete("/webhooks/{id}", middlewares.Authorization(h.adminDeactivateWebhook, s,
+			models.PermWebhooksManage))
+		r.Post("/api-keys", middlewares.Authorization(h.adminCreateAPIKey, s, models.PermAccessManage))
+		r.Delete("/api-keys/{id}", middlewares.Authorization(h.adminRevokeAPIKey, s, models.PermAccessManage))
 	})
 
 	return APIRouter{Mux: router}
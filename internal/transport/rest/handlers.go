@@ -1,25 +1,44 @@
 package rest
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
 	"net/http"
+	"net/netip"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/1Asi1/gophermart/internal/events"
 	"github.com/1Asi1/gophermart/internal/models"
 	"github.com/1Asi1/gophermart/internal/oops"
 	"github.com/1Asi1/gophermart/internal/service"
+	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	"github.com/rs/zerolog"
 )
 
+const (
+	heartbeatInterval = 15 * time.Second
+	maxOrderBodySize  = 1 << 10
+	maxBatchBodySize  = 1 << 20
+	maxBatchSize      = 1000
+)
+
 type handlers struct {
 	service service.Service
+	policy  models.Policy
+	proxies []netip.Prefix
 	log     zerolog.Logger
 }
 
-func newHandlers(s service.Service, log zerolog.Logger) handlers {
-	return handlers{service: s, log: log}
+func newHandlers(s service.Service, policy models.Policy, proxies []netip.Prefix, log zerolog.Logger) handlers {
+	return handlers{service: s, policy: policy, proxies: proxies, log: log}
 }
 
 func (h *handlers) register(w http.ResponseWriter, r *http.Request) {
@@ -33,20 +52,27 @@ func (h *handlers) register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err = user.Validate(); err != nil {
-		l.Error().Err(err).Msg("user.Validate")
-		w.WriteHeader(http.StatusBadRequest)
+	user.Login = models.NormalizeLogin(user.Login)
+	user.ReferralCode = models.NormalizeReferralCode(user.ReferralCode)
+	if err = h.policy.ValidateRegistration(user); err != nil {
+		l.Error().Err(err).Msg("h.policy.ValidateRegistration")
+		writeValidationError(w, l, err)
 		return
 	}
 
-	token, err := h.service.Register(r.Context(), user)
+	token, err := h.service.Register(r.Context(), user, h.clientIP(r))
 	if err != nil {
 		l.Error().Err(err).Msg(" h.service.Register")
-		if errors.Is(err, errors.New("занят")) {
+		if errors.Is(err, oops.ErrLoginTaken) {
 			w.WriteHeader(http.StatusConflict)
 			return
 		}
 
+		if errors.Is(err, oops.ErrReferralInvalid) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -71,11 +97,154 @@ func (h *handlers) login(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	user.Login = models.NormalizeLogin(user.Login)
 
-	token, err := h.service.Login(r.Context(), user)
+	token, err := h.service.Login(r.Context(), user, h.clientIP(r))
 	if err != nil {
 		l.Error().Err(err).Msg("h.service.Login")
-		if errors.Is(err, errors.New("неверная пара логин/пароль")) {
+		if writeLocked(w, err) {
+			return
+		}
+
+		if errors.Is(err, oops.ErrInvalidCredentials) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if errors.Is(err, oops.ErrUserBlocked) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Authorization", token)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *handlers) changePassword(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "changePassword").Logger()
+
+	var req models.PasswordChangeRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		l.Error().Err(err).Msg("json.NewDecoder")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err = req.Validate(); err != nil {
+		l.Error().Err(err).Msg("req.Validate")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	id, err := uuid.Parse(r.Header.Get("ID"))
+	if err != nil {
+		l.Error().Err(err).Msg("uuid.Parse")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	login, err := h.service.UserLogin(r.Context(), id)
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.UserLogin")
+		if errors.Is(err, oops.ErrUserNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err = h.policy.ValidateNewPassword(req.NewPassword, login); err != nil {
+		l.Error().Err(err).Msg("h.policy.ValidateNewPassword")
+		writeValidationError(w, l, err)
+		return
+	}
+
+	token, err := h.service.ChangePassword(r.Context(), id, req, h.clientIP(r))
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.ChangePassword")
+		if writeLocked(w, err) {
+			return
+		}
+
+		if errors.Is(err, oops.ErrInvalidCredentials) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Authorization", token)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *handlers) requestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "requestPasswordReset").Logger()
+
+	var req models.PasswordResetRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		l.Error().Err(err).Msg("json.NewDecoder")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err = req.Validate(); err != nil {
+		l.Error().Err(err).Msg("req.Validate")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	req.Login = models.NormalizeLogin(req.Login)
+	err = h.service.RequestPasswordReset(r.Context(), req, h.clientIP(r))
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.RequestPasswordReset")
+		if writeLocked(w, err) {
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *handlers) confirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "confirmPasswordReset").Logger()
+
+	var req models.PasswordResetConfirm
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		l.Error().Err(err).Msg("json.NewDecoder")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err = req.Validate(); err != nil {
+		l.Error().Err(err).Msg("req.Validate")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err = h.policy.ValidateNewPassword(req.NewPassword, ""); err != nil {
+		l.Error().Err(err).Msg("h.policy.ValidateNewPassword")
+		writeValidationError(w, l, err)
+		return
+	}
+
+	token, err := h.service.ConfirmPasswordReset(r.Context(), req)
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.ConfirmPasswordReset")
+		if errors.Is(err, oops.ErrInvalidToken) {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
@@ -88,20 +257,51 @@ func (h *handlers) login(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+func (h *handlers) getProfile(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "getProfile").Logger()
+
+	id, err := uuid.Parse(r.Header.Get("ID"))
+	if err != nil {
+		l.Error().Err(err).Msg("uuid.Parse")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data, err := h.service.Profile(r.Context(), id)
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.Profile")
+		if errors.Is(err, oops.ErrUserNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, l, data)
+}
+
 func (h *handlers) createOrder(w http.ResponseWriter, r *http.Request) {
 	l := h.log.With().Str("route", "createOrder").Logger()
 
-	contentType := r.Header.Get("Content-Type")
-	if contentType != "text/plain" {
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || contentType != "text/plain" {
 		l.Error().Msg("Content-Type invalid")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	var num int
-	err := json.NewDecoder(r.Body).Decode(&num)
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxOrderBodySize))
 	if err != nil {
-		l.Error().Err(err).Msg("json.NewDecoder")
+		l.Error().Err(err).Msg("io.ReadAll")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	num := strings.TrimSpace(string(body))
+	if num == "" {
+		l.Error().Msg("empty order number")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -113,7 +313,7 @@ func (h *handlers) createOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	req := models.OrderRequest{UserID: id, Number: strconv.Itoa(num)}
+	req := models.OrderRequest{UserID: id, Number: num}
 	if err = req.Validate(); err != nil {
 		l.Error().Err(err).Msg("req.Validate()")
 		w.WriteHeader(http.StatusUnprocessableEntity)
@@ -142,6 +342,102 @@ func (h *handlers) createOrder(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusAccepted)
 }
 
+func (h *handlers) createOrders(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "createOrders").Logger()
+
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		l.Error().Err(err).Msg("mime.ParseMediaType")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBatchBodySize))
+	if err != nil {
+		l.Error().Err(err).Msg("io.ReadAll")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var numbers []string
+	switch contentType {
+	case "application/json":
+		numbers, err = parseJSONNumbers(body)
+		if err != nil {
+			l.Error().Err(err).Msg("parseJSONNumbers")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	case "text/plain":
+		for _, v := range strings.Split(string(body), "\n") {
+			if v = strings.TrimSpace(v); v != "" {
+				numbers = append(numbers, v)
+			}
+		}
+	default:
+		l.Error().Msg("Content-Type invalid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if len(numbers) == 0 || len(numbers) > maxBatchSize {
+		l.Error().Int("count", len(numbers)).Msg("invalid batch size")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	id, err := uuid.Parse(r.Header.Get("ID"))
+	if err != nil {
+		l.Error().Err(err).Msg("uuid.Parse")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	data, err := h.service.CreateOrders(r.Context(), id, numbers)
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.CreateOrders")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res, err := json.Marshal(data)
+	if err != nil {
+		l.Error().Err(err).Msg("json.Marshal")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(res)
+	if err != nil {
+		l.Error().Err(err).Msg("w.Write")
+	}
+}
+
+// parseJSONNumbers accepts an array of strings or bare numbers, the latter are
+// taken verbatim so long numbers keep every digit.
+func parseJSONNumbers(body []byte) ([]string, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+
+	numbers := make([]string, len(raw))
+	for i, v := range raw {
+		if len(v) > 0 && v[0] == '"' {
+			if err := json.Unmarshal(v, &numbers[i]); err != nil {
+				return nil, fmt.Errorf("json.Unmarshal: %w", err)
+			}
+			numbers[i] = strings.TrimSpace(numbers[i])
+			continue
+		}
+		numbers[i] = string(v)
+	}
+
+	return numbers, nil
+}
+
 func (h *handlers) getOrders(w http.ResponseWriter, r *http.Request) {
 	l := h.log.With().Str("route", "getOrders").Logger()
 
@@ -179,6 +475,43 @@ func (h *handlers) getOrders(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (h *handlers) getOrderEvents(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "getOrderEvents").Logger()
+
+	id, err := uuid.Parse(r.Header.Get("ID"))
+	if err != nil {
+		l.Error().Err(err).Msg("uuid.Parse key: ID")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	data, err := h.service.OrderEvents(r.Context(), id, chi.URLParam(r, "number"))
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.OrderEvents")
+		if errors.Is(err, oops.ErrEmptyData) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res, err := json.Marshal(data)
+	if err != nil {
+		l.Error().Err(err).Msg("json.Marshal")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(res)
+	if err != nil {
+		l.Error().Err(err).Msg("w.Write")
+	}
+}
+
 func (h *handlers) getBalance(w http.ResponseWriter, r *http.Request) {
 	l := h.log.With().Str("route", "getBalance").Logger()
 
@@ -193,8 +526,8 @@ func (h *handlers) getBalance(w http.ResponseWriter, r *http.Request) {
 	data, err := h.service.Balance(r.Context(), id)
 	if err != nil {
 		l.Error().Err(err).Msg("h.service.Balance")
-		if errors.Is(err, errors.New("пустой")) {
-			w.WriteHeader(http.StatusNoContent)
+		if errors.Is(err, oops.ErrAccountNotFound) {
+			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
@@ -227,6 +560,17 @@ func (h *handlers) withdraw(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err = req.Validate(); err != nil {
+		l.Error().Err(err).Msg("req.Validate")
+		if errors.Is(err, oops.ErrWithdrawSumInvalid) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
 	id, err := uuid.Parse(r.Header.Get("ID"))
 	if err != nil {
 		l.Error().Err(err).Msg("uuid.Parse")
@@ -242,11 +586,16 @@ func (h *handlers) withdraw(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if errors.Is(err, oops.ErrOrderNumberInvalid) {
+		if errors.Is(err, oops.ErrOrderNumberInvalid) || errors.Is(err, oops.ErrMerchantNotFound) {
 			w.WriteHeader(http.StatusUnprocessableEntity)
 			return
 		}
 
+		if errors.Is(err, oops.ErrWithdrawExists) || errors.Is(err, oops.ErrHoldExists) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
 		if errors.Is(err, oops.ErrInsufficientFunds) {
 			w.WriteHeader(http.StatusPaymentRequired)
 			return
@@ -259,6 +608,191 @@ func (h *handlers) withdraw(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+func (h *handlers) authorizeHold(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "authorizeHold").Logger()
+
+	var req models.WithdrawRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		l.Error().Err(err).Msg("json.NewDecoder")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err = req.Validate(); err != nil {
+		l.Error().Err(err).Msg("req.Validate")
+		if errors.Is(err, oops.ErrWithdrawSumInvalid) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	id, err := uuid.Parse(r.Header.Get("ID"))
+	if err != nil {
+		l.Error().Err(err).Msg("uuid.Parse")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data, err := h.service.AuthorizeHold(r.Context(), id, req)
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.AuthorizeHold")
+		if errors.Is(err, oops.ErrMerchantNotFound) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+
+		if errors.Is(err, oops.ErrWithdrawExists) || errors.Is(err, oops.ErrHoldExists) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		if errors.Is(err, oops.ErrInsufficientFunds) {
+			w.WriteHeader(http.StatusPaymentRequired)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, l, data)
+}
+
+func (h *handlers) captureHold(w http.ResponseWriter, r *http.Request) {
+	h.closeHold(w, r, "captureHold", h.service.CaptureHold)
+}
+
+func (h *handlers) voidHold(w http.ResponseWriter, r *http.Request) {
+	h.closeHold(w, r, "voidHold", h.service.VoidHold)
+}
+
+func (h *handlers) closeHold(
+	w http.ResponseWriter,
+	r *http.Request,
+	route string,
+	closeFn func(context.Context, uuid.UUID, uuid.UUID) (models.Hold, error),
+) {
+	l := h.log.With().Str("route", route).Logger()
+
+	userID, err := uuid.Parse(r.Header.Get("ID"))
+	if err != nil {
+		l.Error().Err(err).Msg("uuid.Parse")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		l.Error().Err(err).Msg("uuid.Parse key: id")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data, err := closeFn(r.Context(), userID, id)
+	if err != nil {
+		l.Error().Err(err).Msg("closeFn")
+		if errors.Is(err, oops.ErrHoldNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if errors.Is(err, oops.ErrHoldNotActive) || errors.Is(err, oops.ErrWithdrawExists) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, l, data)
+}
+
+// transfer requires an Idempotency-Key, a retried transfer must not send
+// the points twice.
+func (h *handlers) transfer(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "transfer").Logger()
+
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		l.Error().Msg("empty Idempotency-Key")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var req models.TransferRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		l.Error().Err(err).Msg("json.NewDecoder")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err = req.Validate(); err != nil {
+		l.Error().Err(err).Msg("req.Validate")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	id, err := uuid.Parse(r.Header.Get("ID"))
+	if err != nil {
+		l.Error().Err(err).Msg("uuid.Parse")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data, err := h.service.Transfer(r.Context(), id, key, req)
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.Transfer")
+		switch {
+		case errors.Is(err, oops.ErrUserNotFound):
+			w.WriteHeader(http.StatusNotFound)
+		case errors.Is(err, oops.ErrTransferInvalid):
+			w.WriteHeader(http.StatusBadRequest)
+		case errors.Is(err, oops.ErrInsufficientFunds):
+			w.WriteHeader(http.StatusPaymentRequired)
+		case errors.Is(err, oops.ErrTransferLimit):
+			w.WriteHeader(http.StatusForbidden)
+		case errors.Is(err, oops.ErrTransferExists):
+			w.WriteHeader(http.StatusConflict)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	writeJSON(w, l, data)
+}
+
+func (h *handlers) getTransfers(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "getTransfers").Logger()
+
+	id, err := uuid.Parse(r.Header.Get("ID"))
+	if err != nil {
+		l.Error().Err(err).Msg("uuid.Parse")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data, err := h.service.Transfers(r.Context(), id)
+	if err != nil {
+		l.Error().Err(err).Msg("h.service.Transfers")
+		if errors.Is(err, oops.ErrEmptyData) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, l, data)
+}
+
 func (h *handlers) getWithdrawals(w http.ResponseWriter, r *http.Request) {
 	l := h.log.With().Str("route", "getWithdrawals").Logger()
 
@@ -295,3 +829,133 @@ func (h *handlers) getWithdrawals(w http.ResponseWriter, r *http.Request) {
 		l.Error().Err(err).Msg("w.Write")
 	}
 }
+
+// events streams the order and balance events of the user. The events live in
+// the memory of the instance that publishes them, run a single instance of the
+// server for the stream to be complete.
+func (h *handlers) events(w http.ResponseWriter, r *http.Request) {
+	l := h.log.With().Str("route", "events").Logger()
+
+	id, err := uuid.Parse(r.Header.Get("ID"))
+	if err != nil {
+		l.Error().Err(err).Msg("uuid.Parse key: ID")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var lastID int64
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		lastID, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			l.Error().Err(err).Msg("strconv.ParseInt key: Last-Event-ID")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The stream outlives the server write timeout.
+	rc := http.NewResponseController(w)
+	if err = rc.SetWriteDeadline(time.Time{}); err != nil {
+		l.Error().Err(err).Msg("rc.SetWriteDeadline")
+	}
+
+	ch, replay, cancel := h.service.Subscribe(id, lastID)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	for _, v := range replay {
+		if err = writeEvent(w, v); err != nil {
+			l.Error().Err(err).Msg("writeEvent")
+			return
+		}
+	}
+	if err = rc.Flush(); err != nil {
+		l.Error().Err(err).Msg("rc.Flush")
+		return
+	}
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			if _, err = fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				l.Error().Err(err).Msg("fmt.Fprint")
+				return
+			}
+		case v, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err = writeEvent(w, v); err != nil {
+				l.Error().Err(err).Msg("writeEvent")
+				return
+			}
+		}
+
+		if err = rc.Flush(); err != nil {
+			l.Error().Err(err).Msg("rc.Flush")
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event events.Event) error {
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	if err != nil {
+		return fmt.Errorf("fmt.Fprintf: %w", err)
+	}
+
+	return nil
+}
+
+// clientIP is the address of the peer, or the one its X-Forwarded-For reports
+// when the peer is a trusted proxy. The header is read from the right and the
+// first address not of a trusted proxy wins, anything left of it may be forged.
+func (h *handlers) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !h.trusted(addr) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+
+		addr = hop.Unmap()
+		if !h.trusted(addr) {
+			break
+		}
+	}
+
+	return addr.String()
+}
+
+func (h *handlers) trusted(addr netip.Addr) bool {
+	for _, v := range h.proxies {
+		if v.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
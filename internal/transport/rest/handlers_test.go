@@ -0,0 +1,200 @@
+package rest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/1Asi1/gophermart/internal/events"
+	"github.com/1Asi1/gophermart/internal/integration/accrual"
+	"github.com/1Asi1/gophermart/internal/integration/notifier"
+	"github.com/1Asi1/gophermart/internal/models"
+	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/1Asi1/gophermart/internal/repository"
+	"github.com/1Asi1/gophermart/internal/service"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+)
+
+// withdrawStore fails every withdrawal with err, the other store methods are
+// not reached by the withdraw handler.
+type withdrawStore struct {
+	service.Store
+	err error
+}
+
+func (s withdrawStore) Withdraw(
+	context.Context,
+	repository.Withdrawals,
+	repository.Notify[repository.Withdrawals],
+) (repository.Balance, error) {
+	return repository.Balance{}, s.err
+}
+
+func TestWithdraw(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		err   error
+		wants int
+	}{
+		{name: "success", body: `{"order":"2377225624","sum":751}`, wants: http.StatusOK},
+		{name: "malformed body", body: `{"order":`, wants: http.StatusUnprocessableEntity},
+		{name: "invalid order number", body: `{"order":"2377225625","sum":751}`, wants: http.StatusUnprocessableEntity},
+		{name: "zero sum", body: `{"order":"2377225624","sum":0}`, wants: http.StatusBadRequest},
+		{name: "negative sum", body: `{"order":"2377225624","sum":-1}`, wants: http.StatusBadRequest},
+		{name: "sum over precision", body: `{"order":"2377225624","sum":1.001}`, wants: http.StatusBadRequest},
+		{
+			name:  "insufficient funds",
+			body:  `{"order":"2377225624","sum":751}`,
+			err:   oops.ErrInsufficientFunds,
+			wants: http.StatusPaymentRequired,
+		},
+		{
+			name:  "order already withdrawn",
+			body:  `{"order":"2377225624","sum":751}`,
+			err:   oops.ErrWithdrawExists,
+			wants: http.StatusConflict,
+		},
+		{
+			name:  "order on hold",
+			body:  `{"order":"2377225624","sum":751}`,
+			err:   oops.ErrHoldExists,
+			wants: http.StatusConflict,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := service.New(
+				withdrawStore{err: tt.err},
+				accrual.Client{},
+				events.New(),
+				notifier.NewLog(zerolog.Nop()),
+				service.Config{},
+			)
+			h := newHandlers(s, models.Policy{}, nil, zerolog.Nop())
+
+			r := httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", strings.NewReader(tt.body))
+			r.Header.Set("ID", uuid.NewString())
+			w := httptest.NewRecorder()
+
+			h.withdraw(w, r)
+
+			if w.Code != tt.wants {
+				t.Errorf("status = %d, wants %d", w.Code, tt.wants)
+			}
+		})
+	}
+}
+
+// luhnNumber appends the Luhn check digit to payload.
+func luhnNumber(payload string) string {
+	sum := 0
+	for i := 0; i < len(payload); i++ {
+		digit := int(payload[len(payload)-1-i] - '0')
+		if i%2 == 0 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+	}
+
+	return fmt.Sprintf("%s%d", payload, (10-sum%10)%10)
+}
+
+// TestCreateOrderConcurrent uploads one number from two users at once against
+// the database of DATABASE_URI, exactly one upload is accepted.
+func TestCreateOrderConcurrent(t *testing.T) {
+	dsn, ok := os.LookupEnv("DATABASE_URI")
+	if !ok {
+		t.Skip("DATABASE_URI is not set")
+	}
+
+	store, err := repository.New(repository.Config{
+		ConnDSN:         dsn,
+		MaxConn:         20,
+		MaxConnLifeTime: time.Minute,
+		MaxConnIdleTime: time.Minute,
+		AutoMigrate:     true,
+	})
+	if err != nil {
+		t.Fatalf("repository.New: %v", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	users := make([]uuid.UUID, 2)
+	for i := range users {
+		users[i] = uuid.New()
+		err = store.Register(ctx, repository.User{
+			ID:           users[i],
+			Login:        "race-" + users[i].String(),
+			Password:     "password",
+			Token:        users[i].String(),
+			Tier:         "base",
+			ReferralCode: strings.ToUpper(users[i].String()[:8]),
+		})
+		if err != nil {
+			t.Fatalf("store.Register: %v", err)
+		}
+	}
+
+	s := service.New(store, accrual.Client{}, events.New(), notifier.NewLog(zerolog.Nop()), service.Config{})
+	h := newHandlers(s, models.Policy{}, nil, zerolog.Nop())
+	number := luhnNumber(fmt.Sprint(time.Now().UnixNano()))
+
+	const uploads = 20
+	codes := make([]int, uploads)
+	var wg sync.WaitGroup
+	for i := 0; i < uploads; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			r := httptest.NewRequest(http.MethodPost, "/api/user/orders", strings.NewReader(number))
+			r.Header.Set("Content-Type", "text/plain")
+			r.Header.Set("ID", users[i%len(users)].String())
+			w := httptest.NewRecorder()
+
+			h.createOrder(w, r)
+			codes[i] = w.Code
+		}(i)
+	}
+	wg.Wait()
+
+	owner := -1
+	for i, v := range codes {
+		if v == http.StatusAccepted {
+			if owner >= 0 {
+				t.Fatalf("upload %d accepted after upload %d", i, owner)
+			}
+			owner = i
+		}
+	}
+	if owner < 0 {
+		t.Fatal("no upload accepted")
+	}
+
+	for i, v := range codes {
+		if i == owner {
+			continue
+		}
+
+		wants := http.StatusConflict
+		if i%len(users) == owner%len(users) {
+			wants = http.StatusOK
+		}
+		if v != wants {
+			t.Errorf("upload %d status = %d, wants %d", i, v, wants)
+		}
+	}
+}
@@ -1,22 +1,43 @@
 package middlewares
 
 import (
+	"errors"
 	"net/http"
+	"strings"
 
+	"github.com/1Asi1/gophermart/internal/oops"
 	"github.com/1Asi1/gophermart/internal/service"
 )
 
-func Authorization(next http.HandlerFunc, service service.Service) http.HandlerFunc {
+// Authorization authenticates the caller and checks that it holds every one
+// of perms. The caller is passed on in the ID, Operator and Permissions
+// headers, Set overwrites whatever the client sent in them.
+func Authorization(next http.HandlerFunc, service service.Service, perms ...string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		token := r.Header.Get("Authorization")
 
-		id, err := service.CheckAccess(r.Context(), token)
+		principal, err := service.CheckAccess(r.Context(), token)
 		if err != nil {
+			if errors.Is(err, oops.ErrUserBlocked) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
-		r.Header.Add("ID", id)
+		for _, v := range perms {
+			if !principal.Can(v) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+
+		r.Header.Set("ID", principal.ID.String())
+		r.Header.Set("Operator", principal.Name)
+		r.Header.Set("Role", principal.Role)
+		r.Header.Set("Permissions", strings.Join(principal.Permissions, ","))
 		next.ServeHTTP(w, r)
 	}
 }
@@ -0,0 +1,142 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/1Asi1/gophermart/internal/models"
+	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/1Asi1/gophermart/internal/service"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	maxIdempotencyKeyLen = 255
+	// maxIdempotentBodySize is well above the bodies of the routes it wraps,
+	// the body is read whole to be hashed.
+	maxIdempotentBodySize = 1 << 16
+)
+
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// Idempotency replays the stored response for a repeated Idempotency-Key and
+// rejects the key with 422 when it is reused for a different request body.
+// It must run after Authorization, keys are scoped per user.
+func Idempotency(next http.HandlerFunc, service service.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLen {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		id, err := uuid.Parse(r.Header.Get("ID"))
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBodySize))
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.New()
+		hash.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+		hash.Write(body)
+
+		resp, replay, err := service.BeginIdempotent(r.Context(), id, key, hex.EncodeToString(hash.Sum(nil)))
+		if err != nil {
+			switch {
+			case errors.Is(err, oops.ErrIdempotencyKeyReused):
+				w.WriteHeader(http.StatusUnprocessableEntity)
+			case errors.Is(err, oops.ErrIdempotencyInProgress):
+				w.WriteHeader(http.StatusConflict)
+			default:
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if replay {
+			w.Header().Set("Idempotent-Replayed", "true")
+			if resp.ContentType != "" {
+				w.Header().Set("Content-Type", resp.ContentType)
+			}
+			w.WriteHeader(resp.StatusCode)
+			_, _ = w.Write(resp.Body)
+			return
+		}
+
+		rec := &recorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		// The response is written already, a client going away must not keep
+		// the key from being finished or released.
+		ctx := context.Background()
+		l := log.With().Str("middleware", "Idempotency").Str("key", key).Logger()
+
+		if rec.status >= http.StatusInternalServerError {
+			release(ctx, l, service, id, key)
+			return
+		}
+
+		err = service.FinishIdempotent(ctx, id, key, models.IdempotentResponse{
+			StatusCode:  rec.status,
+			ContentType: rec.Header().Get("Content-Type"),
+			Body:        rec.body.Bytes(),
+		})
+		if err != nil {
+			// An unfinished key answers retries with 409 until it expires,
+			// released it lets them run again.
+			l.Error().Err(err).Msg("service.FinishIdempotent")
+			release(ctx, l, service, id, key)
+		}
+	}
+}
+
+func release(ctx context.Context, l zerolog.Logger, service service.Service, id uuid.UUID, key string) {
+	if err := service.ReleaseIdempotent(ctx, id, key); err != nil {
+		l.Error().Err(err).Msg("service.ReleaseIdempotent")
+	}
+}
@@ -0,0 +1,65 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/1Asi1/gophermart/internal/models"
+	"github.com/1Asi1/gophermart/internal/oops"
+	"github.com/rs/zerolog"
+)
+
+func writeJSON(w http.ResponseWriter, l zerolog.Logger, data any) {
+	res, err := json.Marshal(data)
+	if err != nil {
+		l.Error().Err(err).Msg("json.Marshal")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(res)
+	if err != nil {
+		l.Error().Err(err).Msg("w.Write")
+	}
+}
+
+// writeValidationError answers 400 with the rejected fields when err carries them.
+func writeValidationError(w http.ResponseWriter, l zerolog.Logger, err error) {
+	var fields models.FieldErrors
+	if !errors.As(err, &fields) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	res, err := json.Marshal(map[string]models.FieldErrors{"errors": fields})
+	if err != nil {
+		l.Error().Err(err).Msg("json.Marshal")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_, err = w.Write(res)
+	if err != nil {
+		l.Error().Err(err).Msg("w.Write")
+	}
+}
+
+// writeLocked answers 429 with Retry-After when err is a lockout and reports
+// whether it did.
+func writeLocked(w http.ResponseWriter, err error) bool {
+	var locked oops.LockedError
+	if !errors.As(err, &locked) {
+		return false
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(locked.RetryAfter.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	return true
+}